@@ -19,6 +19,7 @@ package v1beta1
 import (
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -35,11 +36,32 @@ type DeploymentCopySpec struct {
 	// When both have same keys, values in `Labels` will be applied
 	CustomAnnotations map[string]string `json:"customAnnotations,omitempty"`
 
-	// If non-zero, Replicas will be used for replicas for the copied deployment
+	// If non-zero, Replicas will be used for replicas for the copied deployment.
+	// It can be changed through the scale subresource, e.g. by `kubectl scale` or a HorizontalPodAutoscaler
 	Replicas int32 `json:"replicas"`
 
+	// (optional) if non-zero, replicas of the copied deployment will be kept at this percentage of all ready pods of the original and the copy,
+	// computed from ready replicas of the original deployment. This approximates the weight of traffic to the copy when both are selected by the same Service.
+	// `Replicas` is ignored when defined
+	//+kubebuilder:validation:Minimum=0
+	//+kubebuilder:validation:Maximum=99
+	CanaryWeight int32 `json:"canaryWeight,omitempty"`
+
+	// (optional) if defined, replicas of the copied deployment will follow these steps one by one, ignoring `Replicas` and `CanaryWeight`.
+	// The progression can be paused with the `duplication.k8s.wantedly.com/canary-paused: "true"` annotation
+	// and aborted, scaling the copy to zero, with the `duplication.k8s.wantedly.com/canary-aborted: "true"` annotation
+	CanarySteps []CanaryStep `json:"canarySteps,omitempty"`
+
 	// name defined in `TargetDeploymentName` will be copied
-	TargetDeploymentName string `json:"targetDeploymentName"`
+	TargetDeploymentName string `json:"targetDeploymentName,omitempty"`
+
+	// (optional) if defined, all Deployments matching `TargetSelector` will be copied instead of `TargetDeploymentName`.
+	// Copies are created and deleted as Deployments start or stop matching it
+	TargetSelector *metav1.LabelSelector `json:"targetSelector,omitempty"`
+
+	// (optional) if defined, `TargetDeploymentName` will be looked up in this namespace and the copied deployment will be created there.
+	// When not defined, `.Metadata.Namespace` will be used
+	SourceNamespace string `json:"sourceNamespace,omitempty"`
 
 	// (optional) if defined, the copied deployment will have the specified Hostname
 	Hostname string `json:"hostname"`
@@ -50,6 +72,229 @@ type DeploymentCopySpec struct {
 
 	// name defined in `TargetDeploymentName` will be copied
 	TargetContainers []Container `json:"targetContainers"`
+
+	// (optional) if defined, ConfigMaps and Secrets referenced by the copied deployment will be cloned with the name suffix.
+	// References in the copied pod template are rewritten to the clones
+	ConfigOverrides *ConfigOverrides `json:"configOverrides,omitempty"`
+
+	// (optional) if true, hostnames in env values referring to Deployments copied with the same `NameSuffix`, or Services selecting them,
+	// will be rewritten to their copies. Services selecting the copied deployment will be cloned with `CustomLabels` added to their selectors,
+	// so `CustomLabels` should be defined to keep the original pods out of the clones
+	RewriteServiceReferences bool `json:"rewriteServiceReferences,omitempty"`
+
+	// (optional) if defined, Istio VirtualServices and DestinationRules, or Gateway API HTTPRoutes, will be generated to route matching requests to the copied deployment.
+	// Services selecting the copied deployment will be cloned like `RewriteServiceReferences`
+	Routing *Routing `json:"routing,omitempty"`
+
+	// (optional) if true, label values of the copied pods selected by Services which select the original pods will be rewritten with `NameSuffix`,
+	// so that the copied deployment doesn't receive traffic of the original deployment. Services cloned for the copied deployment select the rewritten labels.
+	// Services still selecting the copied pods are reported in the `Isolated` condition
+	Isolation bool `json:"isolation,omitempty"`
+
+	// (optional) if defined, Ingresses routing to Services which select the copied deployment will be cloned with hosts rewritten.
+	// Services will be cloned like `RewriteServiceReferences`, and backends of the cloned Ingresses point at them
+	Ingress *IngressCopy `json:"ingress,omitempty"`
+
+	// (optional) if defined, metrics of the copied deployment will be queried from Prometheus periodically and compared with thresholds.
+	// The result is reported in the `Healthy` condition
+	Analysis *Analysis `json:"analysis,omitempty"`
+
+	// (optional) what happens to the DeploymentCopy after images and env of `TargetContainers` are promoted to the original deployments
+	// with the `duplication.k8s.wantedly.com/promote: "true"` annotation. `Suspend` scales the copied deployments to zero.
+	// When not defined, `Keep` will be used
+	//+kubebuilder:validation:Enum=Keep;Suspend;Delete
+	AfterPromotion PromotionAction `json:"afterPromotion,omitempty"`
+
+	// (optional) if defined, pods of the copied deployments are monitored for crash loops, restarts and progress deadlines.
+	// On failure the `Failed` condition is set and the action of the policy is taken
+	FailurePolicy *FailurePolicy `json:"failurePolicy,omitempty"`
+
+	// (optional) `Unmanaged` leaves replicas of the copied deployments to others, e.g. `kubectl scale`, and out of the applied spec.
+	// Replicas of copied deployments targeted by a HorizontalPodAutoscaler are always unmanaged. Replicas are still managed while suspended.
+	// When not defined, `Managed` will be used
+	//+kubebuilder:validation:Enum=Managed;Unmanaged
+	ReplicasPolicy ReplicasPolicy `json:"replicasPolicy,omitempty"`
+
+	// (optional) `Snapshot` renders the copied deployments from pod templates of the original deployments taken when the DeploymentCopy was created,
+	// which are stored in a ControllerRevision, instead of following changes to the originals. The snapshot is taken again with the
+	// `duplication.k8s.wantedly.com/refresh-source: "true"` annotation. When not defined, `Follow` will be used
+	//+kubebuilder:validation:Enum=Follow;Snapshot
+	SourcePolicy SourcePolicy `json:"sourcePolicy,omitempty"`
+
+	// (optional) what happens when the original deployment named `TargetDeploymentName` is deleted. `Keep` keeps the copied deployments
+	// reconciled with the spec rendered last time, which is cached in a ControllerRevision. `ScaleToZero` scales them to zero.
+	// `Delete` deletes the DeploymentCopy. When not defined, `Keep` will be used
+	//+kubebuilder:validation:Enum=Keep;ScaleToZero;Delete
+	OnSourceDeleted SourceDeletedAction `json:"onSourceDeleted,omitempty"`
+
+	// (optional) what happens to generated objects when the DeploymentCopy is deleted. `Orphan` keeps the copied deployments
+	// and the ConfigMaps and Secrets they use without owners, e.g. for forensics. `ScaleToZero` keeps them too, but scales the deployments to zero.
+	// Other generated objects are deleted. When not defined, `Delete` will be used
+	//+kubebuilder:validation:Enum=Delete;Orphan;ScaleToZero
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// (optional) what happens when fields of generated objects are owned by another field manager of server-side apply, e.g. `kubectl`.
+	// `Force` takes the ownership of the fields. `Skip` leaves the objects as they are and reports them in `status.conflicts`.
+	// When not defined, `Force` will be used
+	//+kubebuilder:validation:Enum=Force;Skip
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// (optional) if defined, HorizontalPodAutoscalers targeting the original deployments will be cloned to target the copied deployments
+	HorizontalPodAutoscaler *HorizontalPodAutoscalerCopy `json:"horizontalPodAutoscaler,omitempty"`
+
+	// (optional) if defined, PodDisruptionBudgets selecting pods of the original deployments will be cloned to select the copied pods.
+	// Selectors are rewritten like those of cloned Services
+	PodDisruptionBudget *PodDisruptionBudgetCopy `json:"podDisruptionBudget,omitempty"`
+}
+
+// SourcePolicy is whether copied deployments follow changes to the original deployments
+type SourcePolicy string
+
+// Policies on changes to the original deployments
+const (
+	SourceFollow   SourcePolicy = "Follow"
+	SourceSnapshot SourcePolicy = "Snapshot"
+)
+
+// SourceDeletedAction is what happens to a DeploymentCopy when its original deployment is deleted
+type SourceDeletedAction string
+
+// Actions when the original deployment is deleted
+const (
+	SourceDeletedKeep        SourceDeletedAction = "Keep"
+	SourceDeletedScaleToZero SourceDeletedAction = "ScaleToZero"
+	SourceDeletedDelete      SourceDeletedAction = "Delete"
+)
+
+// DeletionPolicy is what happens to generated objects when a DeploymentCopy is deleted
+type DeletionPolicy string
+
+// Policies on deletion
+const (
+	DeletionDelete      DeletionPolicy = "Delete"
+	DeletionOrphan      DeletionPolicy = "Orphan"
+	DeletionScaleToZero DeletionPolicy = "ScaleToZero"
+)
+
+// ConflictPolicy is what happens to generated objects whose fields are owned by other field managers
+type ConflictPolicy string
+
+// Policies on conflicts
+const (
+	ConflictForce ConflictPolicy = "Force"
+	ConflictSkip  ConflictPolicy = "Skip"
+)
+
+// ReplicasPolicy is whether replicas of copied deployments are managed by the DeploymentCopy
+type ReplicasPolicy string
+
+// Policies of replicas
+const (
+	ReplicasManaged   ReplicasPolicy = "Managed"
+	ReplicasUnmanaged ReplicasPolicy = "Unmanaged"
+)
+
+// HorizontalPodAutoscalerCopy defines how HorizontalPodAutoscalers are cloned for the copied deployments
+type HorizontalPodAutoscalerCopy struct {
+	// (optional) minReplicas of the cloned HorizontalPodAutoscalers. When not defined, that of the original will be used
+	//+kubebuilder:validation:Minimum=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// (optional) maxReplicas of the cloned HorizontalPodAutoscalers. When not defined, that of the original will be used.
+	// It is raised to `MinReplicas` when smaller
+	//+kubebuilder:validation:Minimum=1
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+}
+
+// PodDisruptionBudgetCopy defines how PodDisruptionBudgets are cloned for the copied deployments
+type PodDisruptionBudgetCopy struct {
+	// (optional) if defined, the cloned PodDisruptionBudgets use this maxUnavailable, as a number or a percentage, instead of minAvailable and maxUnavailable of the original.
+	// An absolute minAvailable of the original may block evictions of a copy with fewer replicas
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+// FailureAction is what happens to a DeploymentCopy when its copied deployments fail
+type FailureAction string
+
+// Actions on failure
+const (
+	FailureScaleToZero FailureAction = "ScaleToZero"
+	FailureRevert      FailureAction = "Revert"
+)
+
+// FailurePolicy defines failures of copied deployments and what to do with them.
+// A container in `CrashLoopBackOff` and a deployment exceeding its progress deadline are always failures
+type FailurePolicy struct {
+	// (optional) if defined, a container restarted more times than this value is a failure
+	//+kubebuilder:validation:Minimum=0
+	MaxRestarts *int32 `json:"maxRestarts,omitempty"`
+
+	// (optional) `ScaleToZero` scales the copied deployments to zero with the `duplication.k8s.wantedly.com/suspended: "true"` annotation.
+	// `Revert` restores the spec of the DeploymentCopy with which the copied deployments were ready last time, and falls back to `ScaleToZero` when there's no such spec.
+	// When not defined, `ScaleToZero` will be used
+	//+kubebuilder:validation:Enum=ScaleToZero;Revert
+	Action FailureAction `json:"action,omitempty"`
+}
+
+// PromotionAction is what happens to a DeploymentCopy after it is promoted
+type PromotionAction string
+
+// Actions after promotion
+const (
+	PromotionKeep    PromotionAction = "Keep"
+	PromotionSuspend PromotionAction = "Suspend"
+	PromotionDelete  PromotionAction = "Delete"
+)
+
+// IngressCopy defines how Ingresses are cloned for the copied deployment
+type IngressCopy struct {
+	// (optional) Go template of hosts of cloned Ingresses. `{{ .Host }}` is the original host and `{{ .NameSuffix }}` is the name suffix.
+	// When not defined, `{{ .NameSuffix }}.{{ .Host }}` will be used
+	HostTemplate string `json:"hostTemplate,omitempty"`
+}
+
+// CanaryStep is a step of a progressive canary release
+type CanaryStep struct {
+	// (optional) replicas of the copied deployment in this step
+	//+kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// (optional) replicas of the copied deployment in this step, as a number or a percentage of ready replicas of the original deployment, e.g. `25%`.
+	// Ignored when `Replicas` is defined
+	ReplicaRatio *intstr.IntOrString `json:"replicaRatio,omitempty"`
+
+	// (optional) how long this step lasts before moving to the next step.
+	// When not defined, the next step starts immediately. The last step lasts until the progression is aborted
+	Pause *metav1.Duration `json:"pause,omitempty"`
+}
+
+// Analysis defines metrics of the copied deployment compared with thresholds
+type Analysis struct {
+	// (optional) how often metrics are queried. When not defined, `1m` will be used
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// metrics to query for each copied deployment
+	//+kubebuilder:validation:MinItems=1
+	Metrics []AnalysisMetric `json:"metrics"`
+}
+
+// AnalysisMetric is a PromQL query and the range its result should be in
+type AnalysisMetric struct {
+	// name of the metric
+	Name string `json:"name"`
+
+	// Go template of a PromQL query returning a single value. `{{ .Namespace }}` is the namespace, `{{ .Name }}` is the name of the copied deployment,
+	// `{{ .Source }}` is the name of the original deployment and `{{ .NameSuffix }}` is the name suffix,
+	// e.g. `sum(rate(http_requests_total{code=~"5..",deployment="{{ .Name }}"}[5m])) / sum(rate(http_requests_total{deployment="{{ .Name }}"}[5m]))`
+	Query string `json:"query"`
+
+	// (optional) the copied deployment is degraded when the result is less than this value
+	//+kubebuilder:validation:Pattern=`^-?[0-9]+(\.[0-9]+)?$`
+	Min string `json:"min,omitempty"`
+
+	// (optional) the copied deployment is degraded when the result is greater than this value
+	//+kubebuilder:validation:Pattern=`^-?[0-9]+(\.[0-9]+)?$`
+	Max string `json:"max,omitempty"`
 }
 
 // Container should be compatible with "k8s.io/api/apps/v1".Container, so that we can support more fields later on
@@ -59,14 +304,236 @@ type Container struct {
 	Env   []v1.EnvVar `json:"env"`
 }
 
+// ConfigOverrides lists ConfigMaps and Secrets which will be cloned for the copied deployment
+type ConfigOverrides struct {
+	// ConfigMaps referenced by `envFrom`, `valueFrom` or volumes of the copied deployment
+	ConfigMaps []ConfigOverride `json:"configMaps,omitempty"`
+
+	// Secrets referenced by `envFrom`, `valueFrom` or volumes of the copied deployment
+	Secrets []ConfigOverride `json:"secrets,omitempty"`
+}
+
+// ConfigOverride defines a ConfigMap or Secret to clone and the keys to override in the clone
+type ConfigOverride struct {
+	// name of the ConfigMap or Secret to clone
+	Name string `json:"name"`
+
+	// data in `Data` and that of the cloned object will be merged.
+	// When both have same keys, values in `Data` will be applied
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// Routing defines requests which will be routed to the copied deployment.
+// Requests having `Header` or `Cookie` with `Value` reach the copy, and all other requests reach the original deployment
+type Routing struct {
+	// (optional) name of the header to match. When neither `Header` nor `Cookie` is defined, `x-fork` will be used
+	Header string `json:"header,omitempty"`
+
+	// (optional) name of the cookie to match instead of a header
+	Cookie string `json:"cookie,omitempty"`
+
+	// (optional) value of the header or cookie to match. When not defined, `NameSuffix` will be used
+	Value string `json:"value,omitempty"`
+
+	// (optional) if non-zero, this percentage of requests not matching the header or cookie will be routed to the copied deployment too.
+	// It isn't supported by HTTPRoutes generated for Gateway API, which only route matching requests
+	//+kubebuilder:validation:Minimum=0
+	//+kubebuilder:validation:Maximum=100
+	Weight int32 `json:"weight,omitempty"`
+
+	// (optional) if defined, Gateway API HTTPRoutes will be used instead of Istio
+	GatewayAPI *GatewayRouting `json:"gatewayAPI,omitempty"`
+}
+
+// GatewayRouting defines how HTTPRoutes of Gateway API route requests to the copied deployment
+type GatewayRouting struct {
+	// (optional) if defined, rules will be added to this existing HTTPRoute in the namespace of the copied deployment,
+	// in front of its rules sending requests to Services selecting the copied deployment. The rules are removed when the DeploymentCopy is deleted.
+	// When not defined, an HTTPRoute named `<service>-<NameSuffix>` routing matching requests will be generated for each Service
+	HTTPRouteName string `json:"httpRouteName,omitempty"`
+
+	// Gateways which generated HTTPRoutes attach to. Ignored when `HTTPRouteName` is defined
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+
+	// (optional) hostnames of generated HTTPRoutes. Ignored when `HTTPRouteName` is defined
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+// ParentReference should be compatible with ParentReference of Gateway API
+type ParentReference struct {
+	// name of the Gateway
+	Name string `json:"name"`
+
+	// (optional) namespace of the Gateway. When not defined, the namespace of the HTTPRoute will be used
+	Namespace string `json:"namespace,omitempty"`
+
+	// (optional) name of the listener of the Gateway
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// EnvSubstitution is a hostname rewritten in an env value of a copied deployment
+type EnvSubstitution struct {
+	// name of the copied deployment
+	Deployment string `json:"deployment"`
+
+	// name of the container having the env
+	Container string `json:"container"`
+
+	// name of the env
+	Env string `json:"env"`
+
+	// the original value
+	From string `json:"from"`
+
+	// the rewritten value
+	To string `json:"to"`
+}
+
+// CanaryPhase is the phase of the progression of `CanarySteps`
+type CanaryPhase string
+
+// Phases of the progression of `CanarySteps`
+const (
+	CanaryProgressing CanaryPhase = "Progressing"
+	CanaryPaused      CanaryPhase = "Paused"
+	CanaryCompleted   CanaryPhase = "Completed"
+	CanaryAborted     CanaryPhase = "Aborted"
+)
+
+// CanaryStatus is the progress of `CanarySteps`
+type CanaryStatus struct {
+	// index of the current step in `CanarySteps`
+	CurrentStep int32 `json:"currentStep"`
+
+	// when the current step started. Time spent paused isn't counted
+	StepStartedAt metav1.Time `json:"stepStartedAt"`
+
+	// (optional) when the progression was paused
+	PausedAt *metav1.Time `json:"pausedAt,omitempty"`
+
+	// phase of the progression
+	//+kubebuilder:validation:Enum=Progressing;Paused;Completed;Aborted
+	Phase CanaryPhase `json:"phase"`
+}
+
+// AnalysisStatus is the latest result of `Analysis`
+type AnalysisStatus struct {
+	// when metrics were queried last time
+	LastAnalysisTime metav1.Time `json:"lastAnalysisTime"`
+
+	// results of the queries
+	Results []AnalysisResult `json:"results,omitempty"`
+}
+
+// ApplyConflict is a generated object which conflicts with other field managers
+type ApplyConflict struct {
+	// kind of the object
+	Kind string `json:"kind"`
+
+	// name of the object
+	Name string `json:"name"`
+
+	// the error returned by the API server, which lists the conflicting fields and managers
+	Message string `json:"message"`
+}
+
+// AnalysisResult is the result of a query of `Analysis`
+type AnalysisResult struct {
+	// name of the metric
+	Metric string `json:"metric"`
+
+	// name of the copied deployment
+	Deployment string `json:"deployment"`
+
+	// (optional) the result of the query. Empty when the query failed
+	Value string `json:"value,omitempty"`
+
+	// whether the result is in the range of the metric
+	Passed bool `json:"passed"`
+}
+
+// Condition types of DeploymentCopy
+const (
+	// ConditionSourceAuthorized tells whether the creator of the DeploymentCopy may read `SourceNamespace` and create copies there
+	ConditionSourceAuthorized = "SourceAuthorized"
+
+	// ConditionReady tells whether all copied deployments have rolled out and their pods are ready
+	ConditionReady = "Ready"
+
+	// ConditionRoutingReady tells whether routes to the copied deployment are generated
+	ConditionRoutingReady = "RoutingReady"
+
+	// ConditionIngressReady tells whether Ingresses are cloned for the copied deployments with `Ingress`
+	ConditionIngressReady = "IngressReady"
+
+	// ConditionIsolated tells whether no Service other than clones selects pods of the copied deployments
+	ConditionIsolated = "Isolated"
+
+	// ConditionHealthy tells whether metrics of the copied deployments are within the thresholds of `Analysis`
+	ConditionHealthy = "Healthy"
+
+	// ConditionPromoted tells whether `TargetContainers` were promoted to the original deployments
+	ConditionPromoted = "Promoted"
+
+	// ConditionFailed tells whether pods of the copied deployments failed as defined by `FailurePolicy`
+	ConditionFailed = "Failed"
+
+	// ConditionSourceMissing tells whether the original deployment named `TargetDeploymentName` is missing
+	ConditionSourceMissing = "SourceMissing"
+)
+
 // DeploymentCopyStatus defines the observed state of DeploymentCopy
 type DeploymentCopyStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Conditions represent the latest available observations of the DeploymentCopy's state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// the copied Deployment as `<namespace>/<name>`, or the label selector of copied Deployments
+	Source string `json:"source,omitempty"`
+
+	// namespace which objects were generated into. They are cleaned up when `SourceNamespace` changes
+	SourceNamespace string `json:"sourceNamespace,omitempty"`
+
+	// names of the copied deployments
+	Deployments []string `json:"deployments,omitempty"`
+
+	// label selector of pods of the copied deployments, for the scale subresource
+	Selector string `json:"selector,omitempty"`
+
+	// total number of pods of the copied deployments
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// total number of ready pods of the copied deployments
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// env values rewritten by `RewriteServiceReferences`
+	Substitutions []EnvSubstitution `json:"substitutions,omitempty"`
+
+	// URLs served by Ingresses cloned by `Ingress`
+	URLs []string `json:"urls,omitempty"`
+
+	// progress of `CanarySteps`
+	Canary *CanaryStatus `json:"canary,omitempty"`
+
+	// latest result of `Analysis`
+	Analysis *AnalysisStatus `json:"analysis,omitempty"`
+
+	// generated objects which weren't applied because of conflicts with other field managers
+	Conflicts []ApplyConflict `json:"conflicts,omitempty"`
+
+	// when pod templates of the original deployments were taken for `SourcePolicy: Snapshot`
+	SourceSnapshotTime *metav1.Time `json:"sourceSnapshotTime,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
+//+kubebuilder:resource:shortName=dc;dcopy,categories=duplication
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.status.source`
+//+kubebuilder:printcolumn:name="Deployments",type=string,JSONPath=`.status.deployments`,priority=1
+//+kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.status.replicas`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // DeploymentCopy is the Schema for the deploymentcopies API
 type DeploymentCopy struct {
@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeploymentCopySetSpec defines the desired state of DeploymentCopySet
+type DeploymentCopySetSpec struct {
+	// (optional) if defined, all copied deployments will have suffix with this value.
+	// When not defined, `.Metadata.Name` will be used
+	NameSuffix string `json:"nameSuffix,omitempty"`
+
+	// (optional) if defined, all copied deployments will have the specified Hostname
+	Hostname string `json:"hostname,omitempty"`
+
+	// labels in `CustomLabels` will be added to all copied deployments, see DeploymentCopySpec
+	CustomLabels map[string]string `json:"customLabels,omitempty"`
+
+	// annotations in `CustomAnnotations` will be added to all copied deployments, see DeploymentCopySpec
+	CustomAnnotations map[string]string `json:"customAnnotations,omitempty"`
+
+	// (optional) if true, members will refer to each other's copies, see DeploymentCopySpec
+	RewriteServiceReferences bool `json:"rewriteServiceReferences,omitempty"`
+
+	// (optional) if defined, requests will be routed to copies of all members, see DeploymentCopySpec
+	Routing *Routing `json:"routing,omitempty"`
+
+	// (optional) if true, copies will be isolated from Services of the original deployments, see DeploymentCopySpec
+	Isolation bool `json:"isolation,omitempty"`
+
+	// (optional) if defined, Ingresses routing to members will be cloned, see DeploymentCopySpec
+	Ingress *IngressCopy `json:"ingress,omitempty"`
+
+	// a DeploymentCopy will be generated for each member
+	//+listType=map
+	//+listMapKey=targetDeploymentName
+	Members []DeploymentCopySetMember `json:"members"`
+}
+
+// DeploymentCopySetMember defines a Deployment to copy and its overrides
+type DeploymentCopySetMember struct {
+	// name defined in `TargetDeploymentName` will be copied
+	TargetDeploymentName string `json:"targetDeploymentName"`
+
+	// If non-zero, Replicas will be used for replicas for the copied deployment
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// containers of the copied deployment to override
+	TargetContainers []Container `json:"targetContainers,omitempty"`
+
+	// (optional) if defined, ConfigMaps and Secrets referenced by the copied deployment will be cloned, see DeploymentCopySpec
+	ConfigOverrides *ConfigOverrides `json:"configOverrides,omitempty"`
+}
+
+// DeploymentCopySetMemberStatus is the observed state of the DeploymentCopy generated for a member
+type DeploymentCopySetMemberStatus struct {
+	// name of the copied Deployment
+	TargetDeploymentName string `json:"targetDeploymentName"`
+
+	// name of the generated DeploymentCopy
+	DeploymentCopyName string `json:"deploymentCopyName"`
+
+	// true when the `Ready` condition of the DeploymentCopy is true
+	Ready bool `json:"ready"`
+
+	// number of pods of the copied deployment
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// number of ready pods of the copied deployment
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+}
+
+// DeploymentCopySetStatus defines the observed state of DeploymentCopySet
+type DeploymentCopySetStatus struct {
+	// Conditions represent the latest available observations of the DeploymentCopySet's state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// status of each member, in the order of `Members`
+	Members []DeploymentCopySetMemberStatus `json:"members,omitempty"`
+
+	// number of members whose copies are ready
+	ReadyMembers int32 `json:"readyMembers,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=dcset,categories=duplication
+
+// DeploymentCopySet is the Schema for the deploymentcopysets API.
+// It copies a group of Deployments with the same suffix
+type DeploymentCopySet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DeploymentCopySetSpec   `json:"spec,omitempty"`
+	Status DeploymentCopySetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DeploymentCopySetList contains a list of DeploymentCopySet
+type DeploymentCopySetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DeploymentCopySet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DeploymentCopySet{}, &DeploymentCopySetList{})
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExperimentSpec defines the desired state of Experiment
+type ExperimentSpec struct {
+	// name of the Deployment to experiment with
+	TargetDeploymentName string `json:"targetDeploymentName"`
+
+	// labels in `CustomLabels` will be added to copies of all variants, see DeploymentCopySpec
+	CustomLabels map[string]string `json:"customLabels,omitempty"`
+
+	// annotations in `CustomAnnotations` will be added to copies of all variants, see DeploymentCopySpec
+	CustomAnnotations map[string]string `json:"customAnnotations,omitempty"`
+
+	// (optional) if defined, requests having the header or cookie with the name of a variant will be routed to its copy, see DeploymentCopySpec.
+	// Routes are generated by the Experiment for all variants, so the DeploymentCopies have no routing. `Value` and `Weight` are ignored
+	Routing *Routing `json:"routing,omitempty"`
+
+	// (optional) if defined, metrics of copies of all variants will be analyzed, see DeploymentCopySpec
+	Analysis *Analysis `json:"analysis,omitempty"`
+
+	// a DeploymentCopy will be generated for each variant
+	//+listType=map
+	//+listMapKey=name
+	//+kubebuilder:validation:MinItems=1
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+// ExperimentVariant defines overrides of a variant and its share of pods
+type ExperimentVariant struct {
+	// name of the variant. It is used as the name suffix of the copy together with the name of the Experiment
+	Name string `json:"name"`
+
+	// percentage of all ready pods of the original deployment and copies of all variants which the copy of this variant takes.
+	// Pods of the copies keep the labels of the original, so this approximates the weight of traffic to the variant.
+	// The sum of weights of all variants should be less than 100. Otherwise copies of all variants are scaled to zero
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:validation:Maximum=99
+	Weight int32 `json:"weight"`
+
+	// containers of the copied deployment to override
+	TargetContainers []Container `json:"targetContainers,omitempty"`
+
+	// (optional) if defined, ConfigMaps and Secrets referenced by the copied deployment will be cloned, see DeploymentCopySpec
+	ConfigOverrides *ConfigOverrides `json:"configOverrides,omitempty"`
+}
+
+// ExperimentVariantStatus is the observed state of the DeploymentCopy generated for a variant
+type ExperimentVariantStatus struct {
+	// name of the variant
+	Name string `json:"name"`
+
+	// name of the generated DeploymentCopy
+	DeploymentCopyName string `json:"deploymentCopyName"`
+
+	// true when the `Ready` condition of the DeploymentCopy is true
+	Ready bool `json:"ready"`
+
+	// number of pods of the copied deployment
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// number of ready pods of the copied deployment
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// (optional) status of the `Healthy` condition of the DeploymentCopy when `Analysis` is defined
+	Healthy metav1.ConditionStatus `json:"healthy,omitempty"`
+
+	// (optional) latest results of `Analysis` of the DeploymentCopy
+	AnalysisResults []AnalysisResult `json:"analysisResults,omitempty"`
+}
+
+// ExperimentStatus defines the observed state of Experiment
+type ExperimentStatus struct {
+	// Conditions represent the latest available observations of the Experiment's state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// status of each variant, in the order of `Variants`
+	Variants []ExperimentVariantStatus `json:"variants,omitempty"`
+
+	// number of variants whose copies are ready
+	ReadyVariants int32 `json:"readyVariants,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=exp,categories=duplication
+
+// Experiment is the Schema for the experiments API.
+// It copies a Deployment once for each variant, splitting pods among them by weights
+type Experiment struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ExperimentSpec   `json:"spec,omitempty"`
+	Status ExperimentStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ExperimentList contains a list of Experiment
+type ExperimentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Experiment `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Experiment{}, &ExperimentList{})
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+const (
+	defaultAnalysisInterval = time.Minute
+	defaultQueryTimeout     = 30 * time.Second
+)
+
+// MetricsProvider runs queries of `Analysis`
+type MetricsProvider interface {
+	// Query returns the single value which query evaluates to
+	Query(ctx context.Context, query string) (float64, error)
+}
+
+// PrometheusClient is a MetricsProvider querying the HTTP API of Prometheus or a compatible server
+type PrometheusClient struct {
+	// Address is the base URL of the server, e.g. `http://prometheus.monitoring:9090`
+	Address string
+
+	// Client is used to send requests. When nil, http.DefaultClient will be used
+	Client *http.Client
+
+	// Timeout limits each query, so that a slow server doesn't block reconciliation. When zero, 30 seconds will be used
+	Timeout time.Duration
+}
+
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// Query runs an instant query through `/api/v1/query`.
+// A query evaluating to NaN, e.g. a ratio of rates without requests, is an error, because it can't be compared with thresholds
+func (c *PrometheusClient) Query(ctx context.Context, query string) (float64, error) {
+	httpClient := c.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	u := strings.TrimSuffix(c.Address, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	var body prometheusResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, errors.Wrapf(err, "unexpected response with status %d", res.StatusCode)
+	}
+	if body.Status != "success" {
+		return 0, errors.Errorf("query failed: %s", body.Error)
+	}
+
+	// A sample is a pair of a timestamp and a value in a string
+	var sample [2]interface{}
+	switch body.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, errors.WithStack(err)
+		}
+	case "vector":
+		var vector []struct {
+			Value [2]interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(body.Data.Result, &vector); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if len(vector) != 1 {
+			return 0, errors.Errorf("query returned %d series instead of 1", len(vector))
+		}
+		sample = vector[0].Value
+	default:
+		return 0, errors.Errorf("unsupported result type %q", body.Data.ResultType)
+	}
+
+	value, ok := sample[1].(string)
+	if !ok {
+		return 0, errors.Errorf("unexpected sample %v", sample)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if math.IsNaN(f) {
+		return 0, errors.New("query returned NaN")
+	}
+	return f, nil
+}
+
+// analysisTarget is a pair of a copied deployment and its original
+type analysisTarget struct {
+	Namespace  string
+	Name       string
+	Source     string
+	NameSuffix string
+}
+
+// analyze queries metrics of `Analysis` when the interval has passed since the last analysis, and sets the `Healthy` condition.
+// It returns how long to wait until the next analysis, or zero when `Analysis` isn't defined
+func (r *DeploymentCopyReconciler) analyze(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, targets []analysisTarget) time.Duration {
+	analysis := instance.Spec.Analysis
+	if analysis == nil {
+		instance.Status.Analysis = nil
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionHealthy)
+		return 0
+	}
+
+	interval := defaultAnalysisInterval
+	if analysis.Interval != nil && analysis.Interval.Duration > 0 {
+		interval = analysis.Interval.Duration
+	}
+	now := r.now()
+	// The analysis is run again right away when the spec changes, so that new queries don't wait for the interval
+	healthy := meta.FindStatusCondition(instance.Status.Conditions, duplicationv1beta1.ConditionHealthy)
+	if last := instance.Status.Analysis; last != nil && healthy != nil && healthy.ObservedGeneration == instance.Generation {
+		if next := last.LastAnalysisTime.Add(interval); now.Time.Before(next) {
+			return next.Sub(now.Time)
+		}
+	}
+
+	if r.Metrics == nil {
+		r.setCondition(instance, duplicationv1beta1.ConditionHealthy, metav1.ConditionUnknown, "NoMetricsProvider", "the controller isn't configured with a Prometheus address")
+		instance.Status.Analysis = nil
+		return 0
+	}
+
+	status := &duplicationv1beta1.AnalysisStatus{LastAnalysisTime: now}
+	var degraded, failed []string
+	for _, target := range targets {
+		for _, metric := range analysis.Metrics {
+			result := duplicationv1beta1.AnalysisResult{Metric: metric.Name, Deployment: target.Name}
+			value, err := r.queryMetric(ctx, metric, target)
+			if err != nil {
+				log.Error(err, "failed to query a metric", "namespace", instance.Namespace, "name", instance.Name, "metric", metric.Name, "deployment", target.Name)
+				failed = append(failed, fmt.Sprintf("%s of %s", metric.Name, target.Name))
+				status.Results = append(status.Results, result)
+				continue
+			}
+			result.Value = strconv.FormatFloat(value, 'f', -1, 64)
+			result.Passed = inRange(value, metric.Min, metric.Max)
+			if !result.Passed {
+				degraded = append(degraded, fmt.Sprintf("%s of %s is %s", metric.Name, target.Name, result.Value))
+			}
+			status.Results = append(status.Results, result)
+		}
+	}
+	instance.Status.Analysis = status
+
+	message := strings.Join(degraded, ", ")
+	if len(failed) > 0 {
+		if message != "" {
+			message += "; "
+		}
+		message += "failed to query " + strings.Join(failed, ", ")
+	}
+	switch {
+	case len(degraded) > 0:
+		r.setCondition(instance, duplicationv1beta1.ConditionHealthy, metav1.ConditionFalse, "Degraded", message)
+	case len(failed) > 0:
+		r.setCondition(instance, duplicationv1beta1.ConditionHealthy, metav1.ConditionUnknown, "QueryFailed", message)
+	default:
+		r.setCondition(instance, duplicationv1beta1.ConditionHealthy, metav1.ConditionTrue, "AnalysisPassed", "")
+	}
+	return interval
+}
+
+// queryMetric renders the query of metric for target and runs it
+func (r *DeploymentCopyReconciler) queryMetric(ctx context.Context, metric duplicationv1beta1.AnalysisMetric, target analysisTarget) (float64, error) {
+	tmpl, err := template.New(metric.Name).Option("missingkey=error").Parse(metric.Query)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	var query bytes.Buffer
+	if err := tmpl.Execute(&query, target); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return r.Metrics.Query(ctx, query.String())
+}
+
+// inRange returns true when value is in the range of min and max, which are ignored when empty
+func inRange(value float64, min, max string) bool {
+	if min != "" {
+		if m, err := strconv.ParseFloat(min, 64); err == nil && value < m {
+			return false
+		}
+	}
+	if max != "" {
+		if m, err := strconv.ParseFloat(max, 64); err == nil && value > m {
+			return false
+		}
+	}
+	return true
+}
+
+// minRequeue returns the shorter positive duration of a and b
+func minRequeue(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// fieldManager is the field manager of server-side apply requests sent by the controllers
+const fieldManager = "deployment-duplicator"
+
+// objectList is a set of objects of a kind generated for an owner
+type objectList struct {
+	Items            []client.Object
+	GroupVersionKind schema.GroupVersionKind
+	// Identity returns the key telling whether an existing object is one of Items
+	Identity func(client.Object) (string, error)
+}
+
+// applier applies objects generated for an owner with server-side apply, and deletes owned objects which are no longer generated.
+// Fields set by other field managers, like mutating webhooks and HorizontalPodAutoscalers, are kept
+type applier struct {
+	client.Client
+	scheme    *runtime.Scheme
+	namespace string
+	// byLabels tracks objects with owner labels instead of owner references, which can't point to an owner in another namespace
+	byLabels bool
+	// force takes the ownership of fields owned by other field managers
+	force bool
+	// conflicts are objects which weren't applied because force is false, or because they aren't owned and can't be updated
+	conflicts []duplicationv1beta1.ApplyConflict
+}
+
+// newApplier returns an applier of objects in the namespace of the owner, which forces the ownership
+func newApplier(c client.Client, scheme *runtime.Scheme, namespace string) *applier {
+	return &applier{Client: c, scheme: scheme, namespace: namespace, force: true}
+}
+
+// applierFor returns an applier of objects generated for instance into namespace
+func (r *DeploymentCopyReconciler) applierFor(instance *duplicationv1beta1.DeploymentCopy, namespace string) *applier {
+	a := newApplier(r.Client, r.Scheme, namespace)
+	a.byLabels = namespace != instance.Namespace
+	a.force = instance.Spec.ConflictPolicy != duplicationv1beta1.ConflictSkip
+	return a
+}
+
+// Apply applies objects in list and deletes objects of the kind owned by owner which aren't in list
+func (a *applier) Apply(ctx context.Context, owner client.Object, list objectList) error {
+	desired := map[string]bool{}
+	for _, obj := range list.Items {
+		id, err := list.Identity(obj)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		desired[id] = true
+
+		if err := a.setOwner(owner, obj); err != nil {
+			return err
+		}
+		// Apply requests carry the type
+		obj.GetObjectKind().SetGroupVersionKind(list.GroupVersionKind)
+		body, err := applyConfiguration(obj)
+		if err != nil {
+			return err
+		}
+
+		opts := []client.PatchOption{client.FieldOwner(fieldManager)}
+		if a.force {
+			opts = append(opts, client.ForceOwnership)
+		}
+		err = a.Patch(ctx, obj, client.RawPatch(types.ApplyPatchType, body), opts...)
+		if apierrors.IsConflict(err) && !a.force {
+			a.conflicts = append(a.conflicts, duplicationv1beta1.ApplyConflict{
+				Kind:    list.GroupVersionKind.Kind,
+				Name:    obj.GetName(),
+				Message: err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	owned, err := a.listOwned(ctx, owner, list.GroupVersionKind)
+	if err != nil {
+		return err
+	}
+	for i := range owned {
+		id, err := list.Identity(owned[i])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if desired[id] {
+			continue
+		}
+		if err := a.Delete(ctx, owned[i]); client.IgnoreNotFound(err) != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (a *applier) setOwner(owner, obj client.Object) error {
+	if !a.byLabels {
+		return errors.WithStack(controllerutil.SetControllerReference(owner, obj, a.scheme))
+	}
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for key, value := range ownerLabels(owner) {
+		labels[key] = value
+	}
+	obj.SetLabels(labels)
+	return nil
+}
+
+// owns returns true when obj is owned by owner, through owner labels or its controller reference
+func (a *applier) owns(owner, obj client.Object) bool {
+	if !a.byLabels {
+		return metav1.IsControlledBy(obj, owner)
+	}
+	labels := obj.GetLabels()
+	for key, value := range ownerLabels(owner) {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// unownedCopies returns names of DeploymentCopies in copies which already exist without being controlled by owner.
+// They were created by users or other owners, so they are reported instead of being taken over
+func unownedCopies(ctx context.Context, c client.Reader, owner client.Object, copies []client.Object) (map[string]bool, error) {
+	unowned := map[string]bool{}
+	for _, obj := range copies {
+		found := &duplicationv1beta1.DeploymentCopy{}
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), found)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !metav1.IsControlledBy(found, owner) {
+			unowned[obj.GetName()] = true
+		}
+	}
+	return unowned, nil
+}
+
+// listOwned lists objects of gvk owned by owner.
+// Kinds unknown to the scheme, like Istio's, are listed as unstructured, which the manager caches as well
+func (a *applier) listOwned(ctx context.Context, owner client.Object, gvk schema.GroupVersionKind) ([]client.Object, error) {
+	listGVK := gvk.GroupVersion().WithKind(gvk.Kind + "List")
+	var found client.ObjectList = &unstructured.UnstructuredList{}
+	if obj, err := a.scheme.New(listGVK); err == nil {
+		found = obj.(client.ObjectList)
+	}
+	found.GetObjectKind().SetGroupVersionKind(listGVK)
+	opts := []client.ListOption{client.InNamespace(a.namespace)}
+	if a.byLabels {
+		opts = append(opts, ownerLabels(owner))
+	}
+	if err := a.List(ctx, found, opts...); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	items, err := meta.ExtractList(found)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	owned := make([]client.Object, 0, len(items))
+	for _, item := range items {
+		if obj, ok := item.(client.Object); ok && a.owns(owner, obj) {
+			owned = append(owned, obj)
+		}
+	}
+	return owned, nil
+}
+
+// appliedMetadata are fields of metadata set by the controllers. The others are managed by the API server
+var appliedMetadata = []string{"name", "namespace", "labels", "annotations", "ownerReferences"}
+
+// applyConfiguration returns the body of an apply request for obj, which has only the fields set in obj.
+// Typed objects carry empty structs like `creationTimestamp: null`, `strategy: {}` and `status: {}`,
+// which would make the controller own fields it never sets
+func applyConfiguration(obj client.Object) ([]byte, error) {
+	var content map[string]interface{}
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		content = u.DeepCopy().Object
+	} else {
+		var err error
+		if content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		omitZeroStructs(reflect.ValueOf(obj).Elem(), content)
+	}
+	omitNulls(content)
+
+	metadata := map[string]interface{}{}
+	if found, ok := content["metadata"].(map[string]interface{}); ok {
+		for _, key := range appliedMetadata {
+			if value, ok := found[key]; ok {
+				metadata[key] = value
+			}
+		}
+	}
+	content["metadata"] = metadata
+	delete(content, "status")
+
+	body, err := json.Marshal(content)
+	return body, errors.WithStack(err)
+}
+
+// omitZeroStructs removes fields of content holding zero values of non-pointer structs in v, which encoding/json can't omit.
+// Pointers to empty structs like `emptyDir: {}` are kept, as they are set
+func omitZeroStructs(v reflect.Value, content map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline := jsonField(field)
+		if name == "-" {
+			continue
+		}
+		if inline {
+			if v.Field(i).Kind() == reflect.Struct {
+				omitZeroStructs(v.Field(i), content)
+			}
+			continue
+		}
+		value, ok := content[name]
+		if !ok {
+			continue
+		}
+		if v.Field(i).Kind() == reflect.Struct && v.Field(i).IsZero() {
+			delete(content, name)
+			continue
+		}
+		omitZeroValues(v.Field(i), value)
+	}
+}
+
+// omitZeroValues removes zero structs in content, which is the unstructured form of v
+func omitZeroValues(v reflect.Value, content interface{}) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			omitZeroValues(v.Elem(), content)
+		}
+	case reflect.Struct:
+		if m, ok := content.(map[string]interface{}); ok {
+			omitZeroStructs(v, m)
+		}
+	case reflect.Slice:
+		if items, ok := content.([]interface{}); ok && len(items) == v.Len() {
+			for i := range items {
+				omitZeroValues(v.Index(i), items[i])
+			}
+		}
+	case reflect.Map:
+		if m, ok := content.(map[string]interface{}); ok && v.Type().Key().Kind() == reflect.String {
+			for key, value := range m {
+				if elem := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())); elem.IsValid() {
+					omitZeroValues(elem, value)
+				}
+			}
+		}
+	}
+}
+
+// jsonField returns the name of field in JSON, and whether its fields are inlined
+func jsonField(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	name := strings.Split(tag, ",")[0]
+	if strings.Contains(tag, ",inline") || (field.Anonymous && name == "") {
+		return "", true
+	}
+	if name == "" {
+		return field.Name, false
+	}
+	return name, false
+}
+
+// omitNulls removes null values in content recursively
+func omitNulls(content map[string]interface{}) {
+	for key, value := range content {
+		switch value := value.(type) {
+		case nil:
+			delete(content, key)
+		case map[string]interface{}:
+			omitNulls(value)
+		case []interface{}:
+			for _, item := range value {
+				if m, ok := item.(map[string]interface{}); ok {
+					omitNulls(m)
+				}
+			}
+		}
+	}
+}
+
+// appliedChanges drops changes of copied deployments which weren't applied because of conflicts
+func appliedChanges(changes []deploymentChange, conflicts []duplicationv1beta1.ApplyConflict) []deploymentChange {
+	skipped := map[string]bool{}
+	for _, conflict := range conflicts {
+		if conflict.Kind == "Deployment" {
+			skipped[conflict.Name] = true
+		}
+	}
+	applied := make([]deploymentChange, 0, len(changes))
+	for _, change := range changes {
+		if !skipped[change.name] {
+			applied = append(applied, change)
+		}
+	}
+	return applied
+}
+
+// recordConflicts reports objects which weren't applied because of conflicts in the status and Events of instance
+func (r *DeploymentCopyReconciler) recordConflicts(instance *duplicationv1beta1.DeploymentCopy, conflicts []duplicationv1beta1.ApplyConflict) {
+	instance.Status.Conflicts = conflicts
+	for _, conflict := range conflicts {
+		r.event(instance, corev1.EventTypeWarning, "ApplyConflict", fmt.Sprintf("skipped applying %s %s: %s", conflict.Kind, conflict.Name, conflict.Message))
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// cloneAutoscalers renders HorizontalPodAutoscalers and PodDisruptionBudgets of targets for the copied deployments
+func (r *DeploymentCopyReconciler) cloneAutoscalers(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, targets []appsv1.Deployment) ([]client.Object, []client.Object, error) {
+	var hpas, pdbs []client.Object
+	if instance.Spec.HorizontalPodAutoscaler != nil {
+		found := &autoscalingv2.HorizontalPodAutoscalerList{}
+		if err := r.List(ctx, found, client.InNamespace(namespace)); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		for i := range found.Items {
+			hpa := &found.Items[i]
+			ref := hpa.Spec.ScaleTargetRef
+			if ref.Kind != "Deployment" || ref.APIVersion != appsv1.SchemeGroupVersion.String() {
+				continue
+			}
+			for j := range targets {
+				if targets[j].Name == ref.Name {
+					hpas = append(hpas, renderHorizontalPodAutoscaler(instance, hpa))
+				}
+			}
+		}
+	}
+
+	if instance.Spec.PodDisruptionBudget != nil {
+		found := &policyv1.PodDisruptionBudgetList{}
+		if err := r.List(ctx, found, client.InNamespace(namespace)); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		for i := range found.Items {
+			pdb := &found.Items[i]
+			selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+			// An empty selector matches every pod in the namespace, and isn't cloned
+			if err != nil || pdb.Spec.Selector == nil || selector.Empty() {
+				continue
+			}
+			for j := range targets {
+				if selector.Matches(labels.Set(targets[j].Spec.Template.Labels)) {
+					pdbs = append(pdbs, renderPodDisruptionBudget(instance, pdb))
+					break
+				}
+			}
+		}
+	}
+	return hpas, pdbs, nil
+}
+
+// renderHorizontalPodAutoscaler builds a clone of hpa scaling the copied deployment
+func renderHorizontalPodAutoscaler(instance *duplicationv1beta1.DeploymentCopy, hpa *autoscalingv2.HorizontalPodAutoscaler) *autoscalingv2.HorizontalPodAutoscaler {
+	spec := *hpa.Spec.DeepCopy()
+	spec.ScaleTargetRef.Name = copiedDeploymentName(spec.ScaleTargetRef.Name, nameSuffix(instance))
+	if copySpec := instance.Spec.HorizontalPodAutoscaler; copySpec != nil {
+		if copySpec.MinReplicas != nil {
+			minReplicas := *copySpec.MinReplicas
+			spec.MinReplicas = &minReplicas
+		}
+		if copySpec.MaxReplicas != nil {
+			spec.MaxReplicas = *copySpec.MaxReplicas
+		}
+	}
+	if spec.MinReplicas != nil && spec.MaxReplicas < *spec.MinReplicas {
+		spec.MaxReplicas = *spec.MinReplicas
+	}
+
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: clonedObjectMeta(hpa.ObjectMeta, nameSuffix(instance)),
+		Spec:       spec,
+	}
+}
+
+// renderPodDisruptionBudget builds a clone of pdb selecting pods of copied deployments
+func renderPodDisruptionBudget(instance *duplicationv1beta1.DeploymentCopy, pdb *policyv1.PodDisruptionBudget) *policyv1.PodDisruptionBudget {
+	selector := pdb.Spec.Selector.DeepCopy()
+	selector.MatchLabels = forkSelector(instance, selector.MatchLabels)
+
+	spec := policyv1.PodDisruptionBudgetSpec{
+		Selector:       selector,
+		MinAvailable:   pdb.Spec.MinAvailable,
+		MaxUnavailable: pdb.Spec.MaxUnavailable,
+	}
+	if copySpec := instance.Spec.PodDisruptionBudget; copySpec != nil && copySpec.MaxUnavailable != nil {
+		maxUnavailable := *copySpec.MaxUnavailable
+		spec.MinAvailable = nil
+		spec.MaxUnavailable = &maxUnavailable
+	}
+
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: clonedObjectMeta(pdb.ObjectMeta, nameSuffix(instance)),
+		Spec:       spec,
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// Annotations controlling the progression of `CanarySteps`, e.g. with `kubectl annotate`
+const (
+	canaryPausedAnnotation  = "duplication.k8s.wantedly.com/canary-paused"
+	canaryAbortedAnnotation = "duplication.k8s.wantedly.com/canary-aborted"
+)
+
+// advanceCanary walks through `CanarySteps` up to the current time and records the progress in the status.
+// It returns how long to wait until the current step ends, or zero when nothing is scheduled
+func (r *DeploymentCopyReconciler) advanceCanary(instance *duplicationv1beta1.DeploymentCopy) time.Duration {
+	steps := instance.Spec.CanarySteps
+	if len(steps) == 0 {
+		instance.Status.Canary = nil
+		return 0
+	}
+
+	now := r.now()
+	status := instance.Status.Canary
+	if status == nil || int(status.CurrentStep) >= len(steps) {
+		status = &duplicationv1beta1.CanaryStatus{StepStartedAt: now, Phase: duplicationv1beta1.CanaryProgressing}
+	}
+	instance.Status.Canary = status
+
+	annotations := instance.GetAnnotations()
+	if annotations[canaryAbortedAnnotation] == "true" {
+		status.Phase = duplicationv1beta1.CanaryAborted
+		status.PausedAt = nil
+		return 0
+	}
+	if status.Phase == duplicationv1beta1.CanaryAborted {
+		// The progression starts over once the annotation is removed
+		*status = duplicationv1beta1.CanaryStatus{StepStartedAt: now, Phase: duplicationv1beta1.CanaryProgressing}
+	}
+
+	if annotations[canaryPausedAnnotation] == "true" {
+		if status.PausedAt == nil {
+			status.PausedAt = &now
+		}
+		status.Phase = duplicationv1beta1.CanaryPaused
+		return 0
+	}
+	if status.PausedAt != nil {
+		// Time spent paused isn't counted
+		status.StepStartedAt = metav1.NewTime(status.StepStartedAt.Add(now.Sub(status.PausedAt.Time)))
+		status.PausedAt = nil
+	}
+
+	for int(status.CurrentStep) < len(steps)-1 {
+		var pause time.Duration
+		if p := steps[status.CurrentStep].Pause; p != nil {
+			pause = p.Duration
+		}
+		end := status.StepStartedAt.Add(pause)
+		if now.Time.Before(end) {
+			status.Phase = duplicationv1beta1.CanaryProgressing
+			return end.Sub(now.Time)
+		}
+		status.CurrentStep++
+		status.StepStartedAt = metav1.NewTime(end)
+	}
+	status.Phase = duplicationv1beta1.CanaryCompleted
+	return 0
+}
+
+// canaryStepReplicas returns replicas of the copy of target in the current step, and false when `CanarySteps` isn't defined
+func canaryStepReplicas(instance *duplicationv1beta1.DeploymentCopy, target *appsv1.Deployment) (int32, bool) {
+	status := instance.Status.Canary
+	if len(instance.Spec.CanarySteps) == 0 || status == nil || int(status.CurrentStep) >= len(instance.Spec.CanarySteps) {
+		return 0, false
+	}
+	if status.Phase == duplicationv1beta1.CanaryAborted {
+		return 0, true
+	}
+
+	step := instance.Spec.CanarySteps[status.CurrentStep]
+	switch {
+	case step.Replicas != nil:
+		return *step.Replicas, true
+	case step.ReplicaRatio != nil:
+		replicas, err := intstr.GetScaledValueFromIntOrPercent(step.ReplicaRatio, int(target.Status.ReadyReplicas), true)
+		if err != nil {
+			log.Error(err, "invalid replicaRatio", "namespace", instance.Namespace, "name", instance.Name, "step", status.CurrentStep)
+			return 0, false
+		}
+		return int32(replicas), true
+	}
+	return 0, false
+}
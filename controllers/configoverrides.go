@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// cloneConfigs clones ConfigMaps and Secrets listed in `ConfigOverrides` within namespace
+func (r *DeploymentCopyReconciler) cloneConfigs(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string) ([]client.Object, []client.Object, error) {
+	overrides := instance.Spec.ConfigOverrides
+	if overrides == nil {
+		return nil, nil, nil
+	}
+
+	configMaps := make([]client.Object, 0, len(overrides.ConfigMaps))
+	for _, override := range overrides.ConfigMaps {
+		found := &corev1.ConfigMap{}
+		if err := r.Get(ctx, types.NamespacedName{Name: override.Name, Namespace: namespace}, found); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get ConfigMap %s", override.Name)
+		}
+
+		cloned := &corev1.ConfigMap{
+			ObjectMeta: clonedObjectMeta(found.ObjectMeta, nameSuffix(instance)),
+			Data:       map[string]string{},
+			BinaryData: found.BinaryData,
+		}
+		for key, value := range found.Data {
+			cloned.Data[key] = value
+		}
+		for key, value := range override.Data {
+			cloned.Data[key] = value
+		}
+
+		configMaps = append(configMaps, cloned)
+	}
+
+	secrets := make([]client.Object, 0, len(overrides.Secrets))
+	for _, override := range overrides.Secrets {
+		found := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Name: override.Name, Namespace: namespace}, found); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get Secret %s", override.Name)
+		}
+
+		cloned := &corev1.Secret{
+			ObjectMeta: clonedObjectMeta(found.ObjectMeta, nameSuffix(instance)),
+			Type:       found.Type,
+			Data:       map[string][]byte{},
+		}
+		for key, value := range found.Data {
+			cloned.Data[key] = value
+		}
+		for key, value := range override.Data {
+			cloned.Data[key] = []byte(value)
+		}
+
+		secrets = append(secrets, cloned)
+	}
+
+	return configMaps, secrets, nil
+}
+
+func clonedObjectMeta(meta metav1.ObjectMeta, suffix string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        fmt.Sprintf("%s-%s", meta.Name, suffix),
+		Namespace:   meta.Namespace,
+		Labels:      meta.Labels,
+		Annotations: meta.Annotations,
+	}
+}
+
+// renameConfigReferences rewrites references in `envFrom`, `valueFrom` and volumes to ConfigMaps and Secrets cloned by cloneConfigs
+func renameConfigReferences(podSpec *corev1.PodSpec, instance *duplicationv1beta1.DeploymentCopy) {
+	overrides := instance.Spec.ConfigOverrides
+	if overrides == nil {
+		return
+	}
+
+	configMapNames := map[string]string{}
+	for _, override := range overrides.ConfigMaps {
+		configMapNames[override.Name] = fmt.Sprintf("%s-%s", override.Name, nameSuffix(instance))
+	}
+	secretNames := map[string]string{}
+	for _, override := range overrides.Secrets {
+		secretNames[override.Name] = fmt.Sprintf("%s-%s", override.Name, nameSuffix(instance))
+	}
+
+	rename := func(name *string, names map[string]string) {
+		if renamed, ok := names[*name]; ok {
+			*name = renamed
+		}
+	}
+
+	containers := make([]*corev1.Container, 0, len(podSpec.InitContainers)+len(podSpec.Containers))
+	for i := range podSpec.InitContainers {
+		containers = append(containers, &podSpec.InitContainers[i])
+	}
+	for i := range podSpec.Containers {
+		containers = append(containers, &podSpec.Containers[i])
+	}
+
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				rename(&envFrom.ConfigMapRef.Name, configMapNames)
+			}
+			if envFrom.SecretRef != nil {
+				rename(&envFrom.SecretRef.Name, secretNames)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				rename(&env.ValueFrom.ConfigMapKeyRef.Name, configMapNames)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				rename(&env.ValueFrom.SecretKeyRef.Name, secretNames)
+			}
+		}
+	}
+
+	for _, volume := range podSpec.Volumes {
+		if volume.ConfigMap != nil {
+			rename(&volume.ConfigMap.Name, configMapNames)
+		}
+		if volume.Secret != nil {
+			rename(&volume.Secret.SecretName, secretNames)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					rename(&source.ConfigMap.Name, configMapNames)
+				}
+				if source.Secret != nil {
+					rename(&source.Secret.Name, secretNames)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// Annotations recording who created a DeploymentCopy.
+// They are used to authorize copies across namespaces.
+const (
+	creatorAnnotation       = "duplication.k8s.wantedly.com/creator"
+	creatorGroupsAnnotation = "duplication.k8s.wantedly.com/creator-groups"
+)
+
+// CreatorWebhookPath is the path CreatorAnnotator should be registered at
+const CreatorWebhookPath = "/mutate-duplication-k8s-wantedly-com-v1beta1-deploymentcopy"
+
+//+kubebuilder:webhook:path=/mutate-duplication-k8s-wantedly-com-v1beta1-deploymentcopy,mutating=true,failurePolicy=fail,sideEffects=None,groups=duplication.k8s.wantedly.com,resources=deploymentcopies,verbs=create;update,versions=v1beta1,name=mdeploymentcopy.kb.io,admissionReviewVersions=v1
+
+// CreatorAnnotator records the user who created a DeploymentCopy into its annotations.
+// Values set by users are overwritten, and the annotations can't be changed after creation.
+type CreatorAnnotator struct {
+	decoder *admission.Decoder
+}
+
+// Handle implements admission.Handler
+func (a *CreatorAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	instance := &duplicationv1beta1.DeploymentCopy{}
+	if err := a.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	creator := req.UserInfo.Username
+	groups := strings.Join(req.UserInfo.Groups, ",")
+	if req.Operation == admissionv1.Update {
+		old := &duplicationv1beta1.DeploymentCopy{}
+		if err := a.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		creator = old.GetAnnotations()[creatorAnnotation]
+		groups = old.GetAnnotations()[creatorGroupsAnnotation]
+	}
+
+	annotations := instance.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for key, value := range map[string]string{creatorAnnotation: creator, creatorGroupsAnnotation: groups} {
+		if value == "" {
+			delete(annotations, key)
+		} else {
+			annotations[key] = value
+		}
+	}
+	instance.SetAnnotations(annotations)
+
+	marshaled, err := json.Marshal(instance)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (a *CreatorAnnotator) InjectDecoder(d *admission.Decoder) error {
+	a.decoder = d
+	return nil
+}
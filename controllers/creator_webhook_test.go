@@ -0,0 +1,118 @@
+package controllers_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	ddv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/wantedly/deployment-duplicator/controllers"
+	ut "github.com/wantedly/deployment-duplicator/controllers/testing"
+)
+
+func TestCreatorAnnotator(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := ddv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotator := &controllers.CreatorAnnotator{}
+	if err := annotator.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	user := authenticationv1.UserInfo{Username: "some-user", Groups: []string{"some-group", "system:authenticated"}}
+	testcases := []struct {
+		name      string
+		operation admissionv1.Operation
+		object    *ddv1beta1.DeploymentCopy
+		oldObject *ddv1beta1.DeploymentCopy
+		userInfo  authenticationv1.UserInfo
+		expected  map[string]string
+	}{
+		{
+			name:      "create",
+			operation: admissionv1.Create,
+			object:    ut.GenDeploymentCopy("some-deployment-copy", "some-deployment"),
+			userInfo:  user,
+			expected: map[string]string{
+				"duplication.k8s.wantedly.com/creator":        "some-user",
+				"duplication.k8s.wantedly.com/creator-groups": "some-group,system:authenticated",
+			},
+		},
+		{
+			name:      "create with forged creator",
+			operation: admissionv1.Create,
+			object:    ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddCreator("some-admin", "system:masters")),
+			userInfo:  authenticationv1.UserInfo{Username: "some-user"},
+			expected: map[string]string{
+				"duplication.k8s.wantedly.com/creator": "some-user",
+			},
+		},
+		{
+			name:      "update with forged creator",
+			operation: admissionv1.Update,
+			object:    ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddCreator("some-admin", "system:masters"), ut.AddCopyAnnotation("some-annotation", "some-value")),
+			oldObject: ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddCreator("some-user", "some-group")),
+			userInfo:  authenticationv1.UserInfo{Username: "some-admin"},
+			expected: map[string]string{
+				"duplication.k8s.wantedly.com/creator":        "some-user",
+				"duplication.k8s.wantedly.com/creator-groups": "some-group",
+				"some-annotation":                             "some-value",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := json.Marshal(tc.object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: tc.operation,
+				Object:    runtime.RawExtension{Raw: raw},
+				UserInfo:  tc.userInfo,
+			}}
+			if tc.oldObject != nil {
+				if req.OldObject.Raw, err = json.Marshal(tc.oldObject); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res := annotator.Handle(context.Background(), req)
+			if !res.Allowed {
+				t.Fatalf("denied: %v", res.Result)
+			}
+			patch, err := json.Marshal(res.Patches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := jsonpatch.DecodePatch(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := decoded.Apply(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &ddv1beta1.DeploymentCopy{}
+			if err := json.Unmarshal(patched, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.expected, got.Annotations) {
+				t.Errorf("expected annotations %v, got %v", tc.expected, got.Annotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// Owner references can't point to an owner in another namespace,
+// so objects copied into `SourceNamespace` are owned through these labels.
+const (
+	ownerNameLabel      = "duplication.k8s.wantedly.com/owner-name"
+	ownerNamespaceLabel = "duplication.k8s.wantedly.com/owner-namespace"
+)
+
+// ownedKinds are kinds of objects which may be generated for a DeploymentCopy
+var ownedKinds = []schema.GroupVersionKind{
+	corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+	corev1.SchemeGroupVersion.WithKind("Secret"),
+	corev1.SchemeGroupVersion.WithKind("Service"),
+	appsv1.SchemeGroupVersion.WithKind("Deployment"),
+	networkingv1.SchemeGroupVersion.WithKind("Ingress"),
+	policyv1.SchemeGroupVersion.WithKind("PodDisruptionBudget"),
+	autoscalingv2.SchemeGroupVersion.WithKind("HorizontalPodAutoscaler"),
+	virtualServiceGVK,
+	destinationRuleGVK,
+	httpRouteGVK,
+}
+
+func ownerLabels(owner client.Object) client.MatchingLabels {
+	return client.MatchingLabels{
+		ownerNameLabel:      owner.GetName(),
+		ownerNamespaceLabel: owner.GetNamespace(),
+	}
+}
+
+// sourceAccess returns permissions in `SourceNamespace` which the creator of a DeploymentCopy needs.
+// The copies run images and env chosen by the creator, and the generated objects publish them, so reading the original isn't enough.
+// Generated kinds depend on the spec, and routes which aren't owned by the DeploymentCopy are updated when rules are injected into them
+func sourceAccess(instance *duplicationv1beta1.DeploymentCopy) []authorizationv1.ResourceAttributes {
+	// Updating Deployments isn't required, since it allows to promote copies to the originals
+	access := []authorizationv1.ResourceAttributes{
+		{Verb: "get", Group: appsv1.GroupName, Resource: "deployments"},
+		{Verb: "create", Group: appsv1.GroupName, Resource: "deployments"},
+	}
+	access = append(access, writeAccess(corev1.GroupName, "configmaps")...)
+	access = append(access, writeAccess(corev1.GroupName, "secrets")...)
+
+	spec := instance.Spec
+	if clonesServices(instance) {
+		access = append(access, writeAccess(corev1.GroupName, "services")...)
+	}
+	if spec.Ingress != nil {
+		access = append(access, writeAccess(networkingv1.GroupName, "ingresses")...)
+	}
+	if spec.HorizontalPodAutoscaler != nil {
+		access = append(access, writeAccess(autoscalingv2.GroupName, "horizontalpodautoscalers")...)
+	}
+	if spec.PodDisruptionBudget != nil {
+		access = append(access, writeAccess(policyv1.GroupName, "poddisruptionbudgets")...)
+	}
+	switch {
+	case spec.Routing == nil:
+	case spec.Routing.GatewayAPI == nil:
+		// The shared VirtualService is created when no VirtualService covers the original Service
+		access = append(access, writeAccess(destinationRuleGVK.Group, "destinationrules")...)
+		access = append(access, writeAccess(virtualServiceGVK.Group, "virtualservices")...)
+	case usesExistingHTTPRoute(instance):
+		access = append(access, authorizationv1.ResourceAttributes{Verb: "update", Group: httpRouteGVK.Group, Resource: "httproutes"})
+	default:
+		access = append(access, writeAccess(httpRouteGVK.Group, "httproutes")...)
+	}
+	return access
+}
+
+// writeAccess returns permissions to create and update resource
+func writeAccess(group, resource string) []authorizationv1.ResourceAttributes {
+	return []authorizationv1.ResourceAttributes{
+		{Verb: "create", Group: group, Resource: resource},
+		{Verb: "update", Group: group, Resource: resource},
+	}
+}
+
+// authorizeSource checks whether the creator of the DeploymentCopy may read Deployments in namespace and generate copies there.
+// The creator is recorded by CreatorAnnotator.
+func (r *DeploymentCopyReconciler) authorizeSource(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string) (bool, string, error) {
+	return r.authorize(ctx, instance, namespace, sourceAccess(instance))
+}
+
+// authorize checks whether the creator of the DeploymentCopy has all of access in namespace.
+// It returns the reason of the first denied access
+func (r *DeploymentCopyReconciler) authorize(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, access []authorizationv1.ResourceAttributes) (bool, string, error) {
+	if !r.CreatorWebhook {
+		return false, "the webhook recording the creator of DeploymentCopies is disabled, so the creator can't be trusted", nil
+	}
+	user := instance.GetAnnotations()[creatorAnnotation]
+	if user == "" {
+		return false, "the creator of the DeploymentCopy is unknown, the webhook might be disabled", nil
+	}
+	var groups []string
+	if value := instance.GetAnnotations()[creatorGroupsAnnotation]; value != "" {
+		groups = strings.Split(value, ",")
+	}
+
+	for _, attributes := range access {
+		attributes := attributes
+		attributes.Namespace = namespace
+		review := &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:               user,
+				Groups:             groups,
+				ResourceAttributes: &attributes,
+			},
+		}
+		if err := r.Create(ctx, review); err != nil {
+			return false, "", errors.WithStack(err)
+		}
+		if !review.Status.Allowed {
+			reason := review.Status.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("%s may not %s %s in %s", user, attributes.Verb, attributes.Resource, namespace)
+			}
+			return false, reason, nil
+		}
+	}
+	return true, "", nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+const finalizerName = "duplication.k8s.wantedly.com/finalizer"
+
+// orphanedLabel marks objects orphaned by a DeploymentCopy with its name.
+// Orphaned Deployments keep labels of their originals, so it tells them from originals matching `TargetSelector`
+const orphanedLabel = "duplication.k8s.wantedly.com/orphaned-from"
+
+// orphanedKinds are kinds of generated objects which are kept by `Orphan` and `ScaleToZero` deletion policies
+var orphanedKinds = map[schema.GroupVersionKind]bool{
+	corev1.SchemeGroupVersion.WithKind("ConfigMap"):  true,
+	corev1.SchemeGroupVersion.WithKind("Secret"):     true,
+	appsv1.SchemeGroupVersion.WithKind("Deployment"): true,
+}
+
+// deletionPolicy returns `DeletionPolicy`, or `Delete` when it is not defined
+func deletionPolicy(instance *duplicationv1beta1.DeploymentCopy) duplicationv1beta1.DeletionPolicy {
+	if instance.Spec.DeletionPolicy == "" {
+		return duplicationv1beta1.DeletionDelete
+	}
+	return instance.Spec.DeletionPolicy
+}
+
+// finalize deletes or orphans generated objects following the deletion policy, and removes rules added to routes, then removes the finalizer.
+// Objects owned through owner references are left to the garbage collector unless they are orphaned
+func (r *DeploymentCopyReconciler) finalize(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string) error {
+	if !controllerutil.ContainsFinalizer(instance, finalizerName) {
+		return nil
+	}
+
+	policy := deletionPolicy(instance)
+	a := r.applierFor(instance, namespace)
+	for _, gvk := range ownedKinds {
+		orphaned := policy != duplicationv1beta1.DeletionDelete && orphanedKinds[gvk]
+		if !orphaned && !a.byLabels {
+			continue
+		}
+		owned, err := a.listOwned(ctx, instance, gvk)
+		// Optional kinds like Istio's may not be installed
+		if meta.IsNoMatchError(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, obj := range owned {
+			if orphaned {
+				log.Info("orphan copied object", "kind", gvk.Kind, "namespace", namespace, "name", obj.GetName(), "policy", policy)
+				if err := r.orphan(ctx, instance, obj, policy); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Info("delete copied object", "kind", gvk.Kind, "namespace", namespace, "name", obj.GetName())
+			if err := r.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	if err := removeInjectedRules(ctx, r.Client, instance, namespace); err != nil {
+		return err
+	}
+
+	controllerutil.RemoveFinalizer(instance, finalizerName)
+	return errors.WithStack(r.Update(ctx, instance))
+}
+
+// orphan removes the ownership of instance from obj, so that the garbage collector keeps it, and marks it with orphanedLabel.
+// Deployments are scaled to zero with the `ScaleToZero` policy
+func (r *DeploymentCopyReconciler) orphan(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, obj client.Object, policy duplicationv1beta1.DeletionPolicy) error {
+	refs := make([]metav1.OwnerReference, 0, len(obj.GetOwnerReferences()))
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == instance.UID && ref.Kind == "DeploymentCopy" && ref.Name == instance.Name {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	obj.SetOwnerReferences(refs)
+
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for key := range ownerLabels(instance) {
+		delete(labels, key)
+	}
+	labels[orphanedLabel] = instance.Name
+	obj.SetLabels(labels)
+
+	if d, ok := obj.(*appsv1.Deployment); ok && policy == duplicationv1beta1.DeletionScaleToZero {
+		replicas := int32(0)
+		d.Spec.Replicas = &replicas
+	}
+	return errors.WithStack(client.IgnoreNotFound(r.Update(ctx, obj)))
+}
+
+// cleanUp deletes objects generated for instance in namespace, and removes rules added to routes there
+func (r *DeploymentCopyReconciler) cleanUp(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string) error {
+	a := r.applierFor(instance, namespace)
+	for _, gvk := range ownedKinds {
+		err := a.Apply(ctx, instance, objectList{GroupVersionKind: gvk, Identity: identityByName})
+		// Optional kinds like Istio's may not be installed
+		if meta.IsNoMatchError(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return removeInjectedRules(ctx, r.Client, instance, namespace)
+}
@@ -22,18 +22,29 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	"math"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 
 	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
-	refresh "github.com/wantedly/resource-refresher"
 )
 
 var log = logf.Log.WithName("controller")
@@ -43,12 +54,34 @@ type DeploymentCopyReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// Clock is used to record transition times of conditions. The real clock is used when nil
+	Clock clock.PassiveClock
+	// Metrics runs queries of `Analysis`. The `Healthy` condition is Unknown when nil
+	Metrics MetricsProvider
+	// Recorder records Events of DeploymentCopies and their deployments. Events aren't recorded when nil
+	Recorder record.EventRecorder
+	// CreatorWebhook tells whether CreatorAnnotator is registered. Without it anyone can write the creator annotations,
+	// so copies across namespaces are refused
+	CreatorWebhook bool
 }
 
 //+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=deploymentcopies,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=deploymentcopies/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=virtualservices;destinationrules,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=deploymentcopies/finalizers,verbs=update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -67,29 +100,327 @@ func (r *DeploymentCopyReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return reconcile.Result{}, err
 	}
 
-	if instance.Spec.NameSuffix == "" {
-		instance.Spec.NameSuffix = instance.Name
+	if !instance.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, r.finalize(ctx, instance, appliedNamespace(instance))
+	}
+
+	original := instance.Status.DeepCopy()
+	result, err := r.reconcileCopy(ctx, instance)
+	if !equality.Semantic.DeepEqual(original, &instance.Status) {
+		// instance may have been deleted after promotion
+		if updateErr := r.Status().Update(ctx, instance); updateErr != nil && !apierrors.IsNotFound(updateErr) && err == nil {
+			err = errors.WithStack(updateErr)
+		}
+	}
+	return result, err
+}
+
+// reconcileCopy creates or updates objects copied from the target Deployment.
+// Changes to the status of instance are written by the caller.
+func (r *DeploymentCopyReconciler) reconcileCopy(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy) (ctrl.Result, error) {
+	suffix := nameSuffix(instance)
+	namespace := sourceNamespace(instance)
+
+	// Owner references don't work across namespaces and rules added to VirtualServices and existing HTTPRoutes aren't owned,
+	// so they are cleaned up by the finalizer. It also orphans objects before the garbage collector deletes them
+	if namespace != instance.Namespace || injectsRules(instance.Spec.Routing) || deletionPolicy(instance) != duplicationv1beta1.DeletionDelete {
+		if !controllerutil.ContainsFinalizer(instance, finalizerName) {
+			controllerutil.AddFinalizer(instance, finalizerName)
+			if err := r.Update(ctx, instance); err != nil {
+				return reconcile.Result{}, errors.WithStack(err)
+			}
+		}
 	}
 
-	// TODO(munisystem): Set a status into the DeploymentCopy resource if the target deployment doesn't exist
-	target, err := r.getDeployment(ctx, instance.Spec.TargetDeploymentName, instance.Namespace)
+	if previous := instance.Status.SourceNamespace; previous != "" && previous != namespace {
+		log.Info("clean up objects generated into the previous source namespace", "namespace", instance.Namespace, "name", instance.Name, "previous", previous)
+		if err := r.cleanUp(ctx, instance, previous); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	instance.Status.SourceNamespace = namespace
+
+	if namespace == instance.Namespace {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionSourceAuthorized)
+	} else {
+		authorized, message, err := r.authorizeSource(ctx, instance, namespace)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !authorized {
+			log.Info("the creator of DeploymentCopy may not copy from the source namespace", "namespace", instance.Namespace, "name", instance.Name, "sourceNamespace", namespace)
+			r.setCondition(instance, duplicationv1beta1.ConditionSourceAuthorized, metav1.ConditionFalse, "Forbidden", message)
+			recordRenderFailure("SourceForbidden")
+			return reconcile.Result{}, nil
+		}
+		r.setCondition(instance, duplicationv1beta1.ConditionSourceAuthorized, metav1.ConditionTrue, "Allowed", "")
+	}
+
+	instance.Status.Source = namespace + "/" + instance.Spec.TargetDeploymentName
+	if instance.Spec.TargetSelector != nil {
+		instance.Status.Source = metav1.FormatLabelSelector(instance.Spec.TargetSelector)
+	}
+	targets, err := r.getTargets(ctx, instance, namespace)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
-			return reconcile.Result{}, nil
+			message := fmt.Sprintf("Deployment %s is not found in %s", instance.Spec.TargetDeploymentName, namespace)
+			r.setCondition(instance, duplicationv1beta1.ConditionSourceMissing, metav1.ConditionTrue, "SourceNotFound", message)
+			r.event(instance, corev1.EventTypeWarning, "SourceNotFound", message)
+			recordRenderFailure("SourceNotFound")
+			return r.reconcileMissingSource(ctx, instance, namespace, message)
+		}
+		return reconcile.Result{}, err
+	}
+	meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionSourceMissing)
+
+	deleted, err := r.promote(ctx, instance, namespace, targets)
+	if err != nil || deleted {
+		return reconcile.Result{}, err
+	}
+
+	// Promotion writes to the originals, so pod templates are pinned afterwards
+	if err := r.pinSources(ctx, instance, targets); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// Failures are checked before rendering, so that copies are scaled down or reverted in this reconciliation
+	if err := r.checkFailures(ctx, instance, targets, suffix); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	requeueAfter := r.advanceCanary(instance)
+
+	configMaps, secrets, err := r.cloneConfigs(ctx, instance, namespace)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	var services []client.Object
+	var hosts map[string]string
+	var sourceServices []corev1.Service
+	if instance.Spec.Isolation {
+		found := &corev1.ServiceList{}
+		if err := r.List(ctx, found, client.InNamespace(namespace)); err != nil {
+			return reconcile.Result{}, errors.WithStack(err)
+		}
+		sourceServices = found.Items
+	}
+	if clonesServices(instance) {
+		if services, err = cloneServices(ctx, r.Client, instance, namespace, targets); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if instance.Spec.RewriteServiceReferences {
+		if hosts, err = r.forkedHosts(ctx, instance, namespace); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	ingresses, urls, err := r.cloneIngresses(ctx, instance, namespace, services)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	instance.Status.URLs = urls
+
+	hpas, pdbs, err := r.cloneAutoscalers(ctx, instance, namespace, targets)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	unmanaged, err := r.unmanagedReplicas(ctx, instance, namespace, targets, hpas)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	copiedDeploys := make([]client.Object, 0, len(targets))
+	analysisTargets := make([]analysisTarget, 0, len(targets))
+	instance.Status.Substitutions = nil
+	instance.Status.Deployments = nil
+	for i := range targets {
+		copied := renderDeployment(instance, &targets[i], suffix)
+		analysisTargets = append(analysisTargets, analysisTarget{Namespace: namespace, Name: copied.Name, Source: targets[i].Name, NameSuffix: suffix})
+		if instance.Spec.Isolation {
+			isolatePods(copied, &targets[i], sourceServices, suffix)
+		}
+		if instance.Spec.RewriteServiceReferences {
+			instance.Status.Substitutions = append(instance.Status.Substitutions, rewriteServiceReferences(copied, namespace, hosts)...)
+		}
+		if unmanaged[copied.Name] {
+			if err := r.handOverReplicas(ctx, namespace, copied.Name); err != nil {
+				return reconcile.Result{}, err
+			}
+			leaveReplicas(copied)
+		} else {
+			setSpecHash(copied)
 		}
+		copiedDeploys = append(copiedDeploys, copied)
+		instance.Status.Deployments = append(instance.Status.Deployments, copied.Name)
+	}
+	instance.Status.Selector = podSelector(copiedDeploys)
+
+	a := r.applierFor(instance, namespace)
+	changes, copiedDeploys, err := r.detectChanges(ctx, instance, a, copiedDeploys)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
+
+	// ConfigMaps, Secrets, Services and PodDisruptionBudgets are refreshed first so that pods of the copied Deployment can find them
+	lists := []objectList{
+		{
+			Items:            configMaps,
+			GroupVersionKind: corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+			Identity:         identityByName,
+		},
+		{
+			Items:            secrets,
+			GroupVersionKind: corev1.SchemeGroupVersion.WithKind("Secret"),
+			Identity:         identityByName,
+		},
+		{
+			Items:            services,
+			GroupVersionKind: corev1.SchemeGroupVersion.WithKind("Service"),
+			Identity:         identityByName,
+		},
+		{
+			Items:            pdbs,
+			GroupVersionKind: policyv1.SchemeGroupVersion.WithKind("PodDisruptionBudget"),
+			Identity:         identityByName,
+		},
+		{
+			Items:            copiedDeploys,
+			GroupVersionKind: appsv1.SchemeGroupVersion.WithKind("Deployment"),
+			Identity:         identityByName,
+		},
+	}
+
+	for _, copiedDeploy := range copiedDeploys {
+		log.Info("try to create or update copied Deployment", "namespace", copiedDeploy.GetNamespace(), "name", copiedDeploy.GetName())
+	}
+	// Copies are cached before they are applied, which fills in fields managed by the API server
+	cached := &appsv1.DeploymentList{}
+	for _, copiedDeploy := range copiedDeploys {
+		cached.Items = append(cached.Items, *copiedDeploy.(*appsv1.Deployment).DeepCopy())
+	}
+	for _, list := range lists {
+		if err := a.Apply(ctx, instance, list); err != nil {
+			r.recordRefreshFailure(instance, list.GroupVersionKind.Kind, changes, err)
+			return reconcile.Result{}, errors.WithStack(err)
+		}
+	}
+	if err := r.saveRevision(ctx, instance, renderedRevisionName(instance), cached); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.recordChanges(ctx, instance, namespace, appliedChanges(changes, a.conflicts)); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// HorizontalPodAutoscalers are refreshed after the copied Deployment which they scale
+	err = a.Apply(ctx, instance, objectList{
+		Items:            hpas,
+		GroupVersionKind: autoscalingv2.SchemeGroupVersion.WithKind("HorizontalPodAutoscaler"),
+		Identity:         identityByName,
+	})
+	// autoscaling/v2 isn't served by clusters older than Kubernetes 1.23
+	if err != nil && !(len(hpas) == 0 && meta.IsNoMatchError(errors.Cause(err))) {
+		return reconcile.Result{}, errors.WithStack(err)
+	}
+
+	// Ingresses and routes are refreshed after the copied Deployment so that they don't route requests to missing pods
+	err = a.Apply(ctx, instance, objectList{
+		Items:            ingresses,
+		GroupVersionKind: networkingv1.SchemeGroupVersion.WithKind("Ingress"),
+		Identity:         identityByName,
+	})
+	if err != nil {
+		return reconcile.Result{}, errors.WithStack(err)
+	}
+	if err := r.refreshRoutes(ctx, instance, namespace, a, services); err != nil {
+		return reconcile.Result{}, err
+	}
+	r.recordConflicts(instance, a.conflicts)
+
+	if err := r.checkIsolation(ctx, instance, namespace, copiedDeploys); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := r.updateReadiness(ctx, instance, copiedDeploys); err != nil {
+		return reconcile.Result{}, err
+	}
+	requeueAfter = minRequeue(requeueAfter, r.analyze(ctx, instance, analysisTargets))
+	return reconcile.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// updateReadiness aggregates the status of copied Deployments into instance
+func (r *DeploymentCopyReconciler) updateReadiness(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, copiedDeploys []client.Object) error {
+	var replicas, readyReplicas int32
+	var notReady []string
+	for _, copiedDeploy := range copiedDeploys {
+		found := &appsv1.Deployment{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(copiedDeploy), found); err != nil {
+			return errors.WithStack(err)
+		}
+		replicas += found.Status.Replicas
+		readyReplicas += found.Status.ReadyReplicas
+		if !isDeploymentReady(found) {
+			notReady = append(notReady, found.Name)
+		}
+	}
+
+	instance.Status.Replicas = replicas
+	instance.Status.ReadyReplicas = readyReplicas
+	if len(notReady) > 0 {
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionFalse, "DeploymentsNotReady", fmt.Sprintf("waiting for %s to be ready", strings.Join(notReady, ", ")))
+	} else {
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionTrue, "DeploymentsReady", "")
+	}
+	return nil
+}
+
+// isDeploymentReady returns true when the latest spec of d has rolled out and all of its pods are ready
+func isDeploymentReady(d *appsv1.Deployment) bool {
+	desired := int32(1)
+	if d.Spec.Replicas != nil {
+		desired = *d.Spec.Replicas
+	}
+	return d.Status.ObservedGeneration >= d.Generation &&
+		d.Status.UpdatedReplicas >= desired &&
+		d.Status.ReadyReplicas >= desired
+}
+
+// revisionAnnotation is the revision of a Deployment set by the deployment controller
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// renderDeployment builds a copy of target with overrides in instance
+func renderDeployment(instance *duplicationv1beta1.DeploymentCopy, target *appsv1.Deployment, suffix string) *appsv1.Deployment {
 	copied := target.DeepCopy()
 
 	spec := copied.Spec
 	if instance.Spec.Hostname != "" {
 		spec.Template.Spec.Hostname = instance.Spec.Hostname
 	}
-	if instance.Spec.Replicas != 0 {
+	if isSuspended(instance) {
+		replicas := int32(0)
+		spec.Replicas = &replicas
+	} else if replicas, ok := canaryStepReplicas(instance, target); ok {
+		spec.Replicas = &replicas
+	} else if instance.Spec.CanaryWeight != 0 {
+		replicas := canaryReplicas(target.Status.ReadyReplicas, instance.Spec.CanaryWeight)
+		spec.Replicas = &replicas
+	} else if instance.Spec.Replicas != 0 {
 		spec.Replicas = &instance.Spec.Replicas
 	}
 
-	// Inject labels data into copied Deployment
+	// Inject labels data into copied Deployment. Pods of the copy are told from pods of the original by forkLabel.
+	// It isn't added to the selector, which is immutable, so that copies made before it was added aren't recreated
+	if spec.Template.Labels == nil {
+		spec.Template.Labels = map[string]string{}
+	}
+	if spec.Selector == nil {
+		spec.Selector = &metav1.LabelSelector{}
+	}
+	if spec.Selector.MatchLabels == nil {
+		spec.Selector.MatchLabels = map[string]string{}
+	}
+	spec.Template.Labels[forkLabel] = suffix
 	labels := map[string]string{}
 	{
 		for key, value := range copied.GetLabels() {
@@ -106,6 +437,10 @@ func (r *DeploymentCopyReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 	annotations := map[string]string{}
 	{
 		for key, value := range copied.GetAnnotations() {
+			// The revision is owned by the deployment controller of the copy
+			if key == revisionAnnotation {
+				continue
+			}
 			annotations[key] = value
 		}
 		for key, value := range instance.Spec.CustomAnnotations {
@@ -120,49 +455,169 @@ func (r *DeploymentCopyReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 	for i := range spec.Template.Spec.Containers {
 		if container, ok := containers[spec.Template.Spec.Containers[i].Name]; ok {
 			spec.Template.Spec.Containers[i].Image = container.Image
-			spec.Template.Spec.Containers[i].Env = append(
-				spec.Template.Spec.Containers[i].Env,
-				container.Env...,
-			)
+			for _, env := range container.Env {
+				spec.Template.Spec.Containers[i].Env = setEnv(spec.Template.Spec.Containers[i].Env, env)
+			}
 		}
 	}
 
-	copiedDeploy := &appsv1.Deployment{
+	renameConfigReferences(&spec.Template.Spec, instance)
+
+	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        fmt.Sprintf("%s-%s", copied.ObjectMeta.Name, instance.Spec.NameSuffix),
-			Namespace:   instance.Namespace,
+			Name:        copiedDeploymentName(copied.ObjectMeta.Name, suffix),
+			Namespace:   copied.ObjectMeta.Namespace,
 			Labels:      labels,
 			Annotations: annotations,
 		},
 		Spec: spec,
 	}
+}
 
-	copiedDeployList := refresh.ObjectList{
-		Items:            []client.Object{copiedDeploy},
-		GroupVersionKind: appsv1.SchemeGroupVersion.WithKind("Deployment"),
-		Identity: func(obj client.Object) (string, error) {
-			return obj.GetName(), nil
-		},
+// podSelector returns the label selector of pods of all copiedDeploys, made of labels and expressions which their selectors have in common.
+// forkLabel of their pod templates is added, so it doesn't select pods of the originals
+func podSelector(copiedDeploys []client.Object) string {
+	var common *metav1.LabelSelector
+	for _, obj := range copiedDeploys {
+		copied := obj.(*appsv1.Deployment)
+		selector := copied.Spec.Selector
+		if common == nil {
+			common = selector.DeepCopy()
+			if common.MatchLabels == nil {
+				common.MatchLabels = map[string]string{}
+			}
+			// Copies rendered before forkLabel was added don't have it
+			if value, ok := copied.Spec.Template.Labels[forkLabel]; ok {
+				common.MatchLabels[forkLabel] = value
+			}
+			continue
+		}
+		for key, value := range common.MatchLabels {
+			labels := selector.MatchLabels
+			if key == forkLabel {
+				labels = copied.Spec.Template.Labels
+			}
+			if labels[key] != value {
+				delete(common.MatchLabels, key)
+			}
+		}
+		expressions := common.MatchExpressions[:0]
+		for _, expression := range common.MatchExpressions {
+			if containsExpression(selector.MatchExpressions, expression) {
+				expressions = append(expressions, expression)
+			}
+		}
+		common.MatchExpressions = expressions
+	}
+	if common == nil {
+		return ""
+	}
+	selector, err := metav1.LabelSelectorAsSelector(common)
+	if err != nil {
+		// Selectors of the copies were validated by the API server
+		log.Error(err, "invalid selector of copied deployments")
+		return ""
+	}
+	return selector.String()
+}
+
+func containsExpression(expressions []metav1.LabelSelectorRequirement, expression metav1.LabelSelectorRequirement) bool {
+	for _, e := range expressions {
+		if equality.Semantic.DeepEqual(e, expression) {
+			return true
+		}
 	}
+	return false
+}
 
-	log.Info("try to create or update copied Deployment", "namespace", copiedDeploy.Namespace, "name", copiedDeploy.Name)
-	ref := refresh.New(r.Client, r.Scheme)
-	if err := ref.Refresh(ctx, instance, copiedDeployList); err != nil {
-		return reconcile.Result{}, errors.WithStack(err)
+// copiedDeploymentName returns the name of the copy of the Deployment named name
+func copiedDeploymentName(name, suffix string) string {
+	return fmt.Sprintf("%s-%s", name, suffix)
+}
+
+// canaryReplicas returns replicas of a copy taking weight percent of pods together with sourceReplicas pods.
+// At least one replica is kept so that the copy keeps receiving traffic, unless the original has no ready pods,
+// in which case the copy would take all of the traffic
+func canaryReplicas(sourceReplicas int32, weight int32) int32 {
+	if sourceReplicas == 0 {
+		return 0
 	}
+	replicas := int32(math.Round(float64(sourceReplicas) * float64(weight) / float64(100-weight)))
+	if replicas < 1 {
+		return 1
+	}
+	return replicas
+}
 
-	return reconcile.Result{}, nil
+func identityByName(obj client.Object) (string, error) {
+	return obj.GetName(), nil
+}
+
+// nameSuffix returns `NameSuffix`, or `.Metadata.Name` when it is not defined
+func nameSuffix(instance *duplicationv1beta1.DeploymentCopy) string {
+	if instance.Spec.NameSuffix == "" {
+		return instance.Name
+	}
+	return instance.Spec.NameSuffix
+}
+
+// sourceNamespace returns `SourceNamespace`, or `.Metadata.Namespace` when it is not defined
+func sourceNamespace(instance *duplicationv1beta1.DeploymentCopy) string {
+	if instance.Spec.SourceNamespace == "" {
+		return instance.Namespace
+	}
+	return instance.Spec.SourceNamespace
+}
+
+// appliedNamespace returns the namespace which objects of instance were generated into, which may differ from the current `SourceNamespace`
+func appliedNamespace(instance *duplicationv1beta1.DeploymentCopy) string {
+	if instance.Status.SourceNamespace == "" {
+		return sourceNamespace(instance)
+	}
+	return instance.Status.SourceNamespace
+}
+
+// update writes changes of instance except its status. Changes of the status in instance are kept, so that the caller can write them later
+func (r *DeploymentCopyReconciler) update(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy) error {
+	status := instance.Status.DeepCopy()
+	err := r.Update(ctx, instance)
+	instance.Status = *status
+	return errors.WithStack(err)
+}
+
+func (r *DeploymentCopyReconciler) now() metav1.Time {
+	return clockNow(r.Clock)
+}
+
+// clockNow returns the current time of c, or of the real clock when c is nil
+func clockNow(c clock.PassiveClock) metav1.Time {
+	if c == nil {
+		return metav1.Now()
+	}
+	return metav1.NewTime(c.Now())
 }
 
-func (r *DeploymentCopyReconciler) getDeployment(ctx context.Context, name, namespace string) (*appsv1.Deployment, error) {
-	found := &appsv1.Deployment{}
-	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, found)
-	return found, err
+func (r *DeploymentCopyReconciler) setCondition(instance *duplicationv1beta1.DeploymentCopy, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: instance.Generation,
+		LastTransitionTime: r.now(),
+		Reason:             reason,
+		Message:            message,
+	})
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DeploymentCopyReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&duplicationv1beta1.DeploymentCopy{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&networkingv1.Ingress{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.deploymentCopiesForDeployment)).
+		Watches(&source.Kind{Type: &duplicationv1beta1.DeploymentCopy{}}, handler.EnqueueRequestsFromMapFunc(r.deploymentCopiesWithSameSuffix)).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.deploymentCopiesForService)).
 		Complete(r)
 }
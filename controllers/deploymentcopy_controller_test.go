@@ -2,13 +2,25 @@ package controllers_test
 
 import (
 	"context"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	ddv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -21,6 +33,14 @@ type testcase struct {
 	name         string
 	explanation  string
 	initialState []runtime.Object
+	// lists to snapshot in addition to DeploymentCopies and Deployments
+	lists []ctrlclient.ObjectList
+	// results of PromQL queries returned by a stub of Prometheus
+	metrics map[string]string
+	// accesses denied to the creator of the DeploymentCopy, like "create secrets"
+	denied []string
+	// whether the webhook recording creators is disabled
+	webhookDisabled bool
 }
 
 func TestDeploymentCopyReconciler(t *testing.T) {
@@ -29,6 +49,8 @@ func TestDeploymentCopyReconciler(t *testing.T) {
 	regs := []func(*runtime.Scheme) error{
 		ddv1beta1.AddToScheme,
 		clientgoscheme.AddToScheme,
+		ut.AddIstioToScheme,
+		ut.AddGatewayAPIToScheme,
 	}
 
 	for _, add := range regs {
@@ -37,6 +59,10 @@ func TestDeploymentCopyReconciler(t *testing.T) {
 		}
 	}
 
+	ratio25 := intstr.FromString("25%")
+	ratio50 := intstr.FromString("50%")
+	maxUnavailable := intstr.FromInt(1)
+
 	testcases := []testcase{
 		{
 			name:         "no resources",
@@ -67,6 +93,213 @@ func TestDeploymentCopyReconciler(t *testing.T) {
 				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag")),
 			},
 		},
+		{
+			name:        "drift reverted",
+			explanation: "should revert changes to the copied deployment made by others and record an Event",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "edited-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.AddAnnotation("duplication.k8s.wantedly.com/spec-hash", "089ac0a3")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag")),
+			},
+		},
+		{
+			name:        "replicas scaled by hpa",
+			explanation: "should keep replicas of the copied deployment targeted by an HPA without recording drift",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(3)),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(7), ut.ManagedBy("kube-controller-manager", `{"f:spec":{"f:replicas":{}}}`)),
+				ut.GenHorizontalPodAutoscaler("some-deployment-some-deployment-copy", "some-deployment-some-deployment-copy", 2, 10),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetReplicas(2)),
+			},
+		},
+		{
+			name:        "replicas unmanaged",
+			explanation: "should keep replicas of the existing copied deployment with replicasPolicy Unmanaged",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(3)),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(7), ut.ManagedBy("kubectl", `{"f:spec":{"f:replicas":{}}}`)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetReplicas(2), ut.SetReplicasPolicy(ddv1beta1.ReplicasUnmanaged)),
+			},
+		},
+		{
+			name:        "replicas unmanaged without another manager",
+			explanation: "should keep replicas which only the controller applied when it stops applying them",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(3)),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(3),
+					func(d *appsv1.Deployment) { d.Spec.Replicas = pointer.Int32(3) },
+					ut.AppliedBy("deployment-duplicator", `{"f:spec":{"f:replicas":{}}}`),
+				),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetReplicas(3), ut.SetReplicasPolicy(ddv1beta1.ReplicasUnmanaged)),
+			},
+		},
+		{
+			name:        "apply conflict forced",
+			explanation: "should take the ownership of fields owned by another field manager by default",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(5), ut.ManagedBy("kubectl", `{"f:spec":{"f:replicas":{}}}`)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetReplicas(2)),
+			},
+		},
+		{
+			name:        "apply keeps fields of other managers",
+			explanation: "should keep fields set by other field managers and remove fields the controller no longer sets",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"),
+					ut.AddAnnotation("sidecar.istio.io/status", "injected"),
+					ut.AddAnnotation("some-stale-annotation", "some-value"),
+					ut.ManagedBy("istio-sidecar-injector", `{"f:metadata":{"f:annotations":{"f:sidecar.istio.io/status":{}}}}`),
+				),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag")),
+			},
+		},
+		{
+			name:        "apply conflict skipped",
+			explanation: "should leave the copied deployment with conflicts as it is and report the conflict with conflictPolicy Skip",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(5), ut.ManagedBy("kubectl", `{"f:spec":{"f:replicas":{}}}`)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetReplicas(2), ut.SetConflictPolicy(ddv1beta1.ConflictSkip)),
+			},
+		},
+		{
+			name:        "deletion policy finalizer",
+			explanation: "should add the finalizer to orphan the copied deployment on deletion",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetDeletionPolicy(ddv1beta1.DeletionOrphan)),
+			},
+		},
+		{
+			name:        "deletion policy orphan",
+			explanation: "should remove the owner reference from the copied deployment and the finalizer",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(3)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetDeletionPolicy(ddv1beta1.DeletionOrphan), ut.MarkDeleted()),
+			},
+		},
+		{
+			name:        "deletion policy scaleToZero",
+			explanation: "should orphan the copied deployment scaled to zero",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(3)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetDeletionPolicy(ddv1beta1.DeletionScaleToZero), ut.MarkDeleted()),
+			},
+		},
+		{
+			name:        "rendered revision",
+			explanation: "should cache the rendered copied deployment in a ControllerRevision",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag")),
+			},
+			lists: []ctrlclient.ObjectList{
+				&appsv1.ControllerRevisionList{},
+			},
+		},
+		{
+			name:        "source deleted keep",
+			explanation: "should keep reconciling the copied deployment with the cached spec and report the missing source",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "edited-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(2)),
+				ut.GenRenderedRevision("some-deployment-copy", ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"))),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag")),
+			},
+		},
+		{
+			name:        "source deleted scaleToZero",
+			explanation: "should scale the cached copied deployment to zero",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(2)),
+				ut.GenRenderedRevision("some-deployment-copy", ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"))),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetOnSourceDeleted(ddv1beta1.SourceDeletedScaleToZero)),
+			},
+		},
+		{
+			name:        "source deleted delete",
+			explanation: "should delete the DeploymentCopy whose source is missing",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetOnSourceDeleted(ddv1beta1.SourceDeletedDelete)),
+			},
+		},
+		{
+			name:        "source deleted with routing",
+			explanation: "should delete routes, ingresses and services cloned for the copy and report that routing isn't ready",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments-pr-42", map[string]string{"app": "payments", "duplication.k8s.wantedly.com/fork": "pr-42"}, ut.AddContainer("app", "payments:latest"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(1)),
+				ut.GenRenderedRevision("some-deployment-copy", ut.GenDeployment("payments-pr-42", map[string]string{"app": "payments", "duplication.k8s.wantedly.com/fork": "pr-42"}, ut.AddContainer("app", "payments:latest"))),
+				ut.OwnedByCopy(ut.GenService("payments-pr-42", map[string]string{"app": "payments", "duplication.k8s.wantedly.com/fork": "pr-42"}), "some-deployment-copy"),
+				ut.OwnedByCopy(ut.GenIngress("api-pr-42", []string{"payments-pr-42.api.qa.example.com"}, []string{"payments-pr-42"}, false), "some-deployment-copy"),
+				ut.OwnedByCopy(ut.GenUnstructured(ut.VirtualServiceGVK, "payments-pr-42", map[string]interface{}{"hosts": []interface{}{"payments"}}), "some-deployment-copy"),
+				ut.OwnedByCopy(ut.GenUnstructured(ut.DestinationRuleGVK, "payments-pr-42", map[string]interface{}{"host": "payments-pr-42"}), "some-deployment-copy"),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{}),
+					ut.SetIngress("{{ .NameSuffix }}-{{ .Host }}"),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+				&networkingv1.IngressList{},
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+				ut.UnstructuredList(ut.DestinationRuleGVK),
+			},
+		},
+		{
+			name:        "source snapshot taken",
+			explanation: "should store pod templates of the original deployment in a ControllerRevision",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar:v1")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetSourcePolicy(ddv1beta1.SourceSnapshot)),
+			},
+			lists: []ctrlclient.ObjectList{
+				&appsv1.ControllerRevisionList{},
+			},
+		},
+		{
+			name:        "source snapshot pinned",
+			explanation: "should render the copied deployment from the snapshot instead of the changed original",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar:v2")),
+				ut.GenSourceRevision("some-deployment-copy", ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar:v1"))),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetSourcePolicy(ddv1beta1.SourceSnapshot)),
+			},
+		},
+		{
+			name:        "source snapshot refreshed",
+			explanation: "should take the snapshot again and remove the annotation requesting it",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar:v2")),
+				ut.GenSourceRevision("some-deployment-copy", ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar:v1"))),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.SetSourcePolicy(ddv1beta1.SourceSnapshot), ut.AddCopyAnnotation("duplication.k8s.wantedly.com/refresh-source", "true")),
+			},
+			lists: []ctrlclient.ObjectList{
+				&appsv1.ControllerRevisionList{},
+			},
+		},
+		{
+			name:        "selector changed",
+			explanation: "should recreate the copied deployment because selectors are immutable",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web", "fork": "old"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.AddCustomLabel("fork", "new")),
+			},
+		},
+		{
+			name:        "selector changed on a deployment not owned",
+			explanation: "should keep the deployment which isn't owned by the DeploymentCopy and report a conflict",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "role": "web", "fork": "old"}, ut.AddContainer("some-container", "another-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment", ut.AddTargetContainer("some-container", "another-image-tag"), ut.AddCustomLabel("fork", "new")),
+			},
+		},
 		{
 			name:        "labels and annotations are respected",
 			explanation: "copied deployments are respected source labels and annotations",
@@ -87,16 +320,878 @@ func TestDeploymentCopyReconciler(t *testing.T) {
 				),
 			},
 		},
+		{
+			name:        "configOverrides",
+			explanation: "referenced ConfigMaps and Secrets are cloned with overrides and references are rewritten",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"},
+					ut.AddContainer("some-container", "some-image-tag"),
+					ut.AddConfigMapEnvFrom("some-container", "some-config"),
+					ut.AddSecretKeyRef("some-container", "SOME_TOKEN", "some-secret", "token"),
+					ut.AddConfigMapVolume("some-volume", "some-config"),
+				),
+				ut.GenConfigMap("some-config", map[string]string{"SOME_URL": "http://some-url", "SOME_FLAG": "false"}),
+				ut.GenSecret("some-secret", map[string]string{"token": "some-token", "password": "some-password"}),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddConfigMapOverride("some-config", map[string]string{"SOME_FLAG": "true"}),
+					ut.AddSecretOverride("some-secret", map[string]string{"token": "another-token"}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ConfigMapList{},
+				&corev1.SecretList{},
+			},
+		},
+		{
+			name:        "cross namespace copy without creator",
+			explanation: "do nothing because the creator can't be authorized",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddSourceNamespace("source-namespace"),
+				),
+			},
+		},
+		{
+			name:        "cross namespace copy",
+			explanation: "should make a copy owned through labels in the source namespace",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddSourceNamespace("source-namespace"),
+					ut.AddCreator("some-user", "some-group"),
+				),
+			},
+		},
+		{
+			name:        "cross namespace copy without webhook",
+			explanation: "do nothing because the creator annotation may be written by anyone without the webhook",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddSourceNamespace("source-namespace"),
+					ut.AddCreator("some-admin", "system:masters"),
+				),
+			},
+			webhookDisabled: true,
+		},
+		{
+			name:        "cross namespace copy without create access",
+			explanation: "do nothing because the creator may read the source namespace but not create Secrets there",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddSourceNamespace("source-namespace"),
+					ut.AddCreator("some-user", "some-group"),
+				),
+			},
+			denied: []string{"create secrets"},
+		},
+		{
+			name:        "cross namespace copy moved",
+			explanation: "should delete the copy in the previous source namespace and make a copy in the new one",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("previous-namespace")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{
+					"app":  "some-app",
+					"role": "web",
+					"duplication.k8s.wantedly.com/owner-name":      "some-deployment-copy",
+					"duplication.k8s.wantedly.com/owner-namespace": "some-namespace",
+				}, ut.AddContainer("some-container", "another-image-tag"), ut.SetNamespace("previous-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddSourceNamespace("source-namespace"),
+					ut.AddCreator("some-user", "some-group"),
+					ut.SetAppliedNamespace("previous-namespace"),
+				),
+			},
+		},
+		{
+			name:        "deleted cross namespace copy",
+			explanation: "should delete the copy in the source namespace and remove the finalizer",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app", "role": "web"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{
+					"app":  "some-app",
+					"role": "web",
+					"duplication.k8s.wantedly.com/owner-name":      "some-deployment-copy",
+					"duplication.k8s.wantedly.com/owner-namespace": "some-namespace",
+				}, ut.AddContainer("some-container", "another-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddSourceNamespace("source-namespace"),
+					ut.AddCreator("some-user", "some-group"),
+					ut.MarkDeleted(),
+				),
+			},
+		},
+		{
+			name:        "ready copy",
+			explanation: "should report readiness of the copied deployment",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(2)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetReplicas(2),
+				),
+			},
+		},
+		{
+			name:        "rewriteServiceReferences",
+			explanation: "should rewrite references to services cloned by copies with the same suffix, but not to services which aren't cloned, and clone services selecting the copy",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"},
+					ut.AddContainer("app", "payments:latest"),
+					ut.AddEnv("app", "USERS_URL", "http://users"),
+					ut.AddEnv("app", "USERS_FQDN", "users.some-namespace.svc.cluster.local:80,users:80"),
+					ut.AddEnv("app", "USERS_EXTERNAL_URL", "https://users.example.com"),
+					ut.AddEnv("app", "USERS_API_URL", "http://users-api"),
+					ut.AddEnv("app", "ORDERS_URL", "http://orders"),
+				),
+				ut.GenDeployment("users", map[string]string{"app": "users"}, ut.AddContainer("app", "users:latest")),
+				ut.GenDeployment("orders", map[string]string{"app": "orders"}, ut.AddContainer("app", "orders:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenService("users", map[string]string{"app": "users"}),
+				ut.GenService("orders", map[string]string{"app": "orders"}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.EnableServiceRewrite(),
+				),
+				ut.GenDeploymentCopy("users-copy", "users", ut.SetNameSuffix("pr-42")),
+				ut.GenDeploymentCopy("orders-copy", "orders", ut.SetNameSuffix("pr-42"), ut.EnableServiceRewrite()),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+			},
+		},
+		{
+			name:        "routing",
+			explanation: "should route requests with the header to a clone of the service and inherit the traffic policy of the service",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenUnstructured(ut.DestinationRuleGVK, "payments", map[string]interface{}{
+					"host":          "payments.some-namespace.svc.cluster.local",
+					"trafficPolicy": map[string]interface{}{"connectionPool": map[string]interface{}{"http": map[string]interface{}{"maxRetries": int64(3)}}},
+				}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+				ut.UnstructuredList(ut.DestinationRuleGVK),
+			},
+		},
+		{
+			name:        "routing by cookie without services",
+			explanation: "should report that no service selects the copy",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{Cookie: "fork", Value: "pr-42"}),
+				),
+			},
+		},
+		{
+			name:        "routing with another fork",
+			explanation: "should add rules to the VirtualService shared with another fork and delete the VirtualService generated before",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.OwnedByCopy(ut.GenUnstructured(ut.VirtualServiceGVK, "payments-pr-42", map[string]interface{}{"hosts": []interface{}{"payments"}}), "some-deployment-copy"),
+				ut.AddUnstructuredLabel(ut.AddUnstructuredAnnotation(ut.GenUnstructured(ut.VirtualServiceGVK, "payments-forks", map[string]interface{}{
+					"hosts": []interface{}{"payments"},
+					"http": []interface{}{
+						map[string]interface{}{
+							"name":  "fork-pr-1",
+							"match": []interface{}{map[string]interface{}{"headers": map[string]interface{}{"x-fork": map[string]interface{}{"exact": "pr-1"}}}},
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "payments-pr-1"}}},
+						},
+						map[string]interface{}{
+							"name":  "source",
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "payments"}}},
+						},
+					},
+				}), "duplication.k8s.wantedly.com/owned-rules", `{"DeploymentCopy/some-namespace/another-copy":[{"match":[{"headers":{"x-fork":{"exact":"pr-1"}}}],"name":"fork-pr-1","route":[{"destination":{"host":"payments-pr-1"}}]}]}`), "duplication.k8s.wantedly.com/shared-route", "true"),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+			},
+		},
+		{
+			name:        "routing with an existing virtual service",
+			explanation: "should add rules for the header and 10% of the others in front of rules of the VirtualService sending requests to the service",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenUnstructured(ut.VirtualServiceGVK, "api", map[string]interface{}{
+					"hosts": []interface{}{"payments.some-namespace.svc.cluster.local", "users"},
+					"http": []interface{}{
+						map[string]interface{}{
+							"match":   []interface{}{map[string]interface{}{"uri": map[string]interface{}{"prefix": "/payments"}}},
+							"route":   []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "payments.some-namespace.svc.cluster.local", "port": map[string]interface{}{"number": int64(80)}}}},
+							"timeout": "5s",
+						},
+						map[string]interface{}{
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "users"}}},
+						},
+					},
+				}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{Weight: 10}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+			},
+		},
+		{
+			name:        "routing with subsets",
+			explanation: "should route to the clone without subsets, and keep the split of the other requests between the subsets",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments", "version": "v1"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenUnstructured(ut.DestinationRuleGVK, "payments", map[string]interface{}{
+					"host": "payments",
+					"subsets": []interface{}{
+						map[string]interface{}{"name": "v1", "labels": map[string]interface{}{"version": "v1"}},
+						map[string]interface{}{"name": "v2", "labels": map[string]interface{}{"version": "v2"}},
+					},
+				}),
+				ut.GenUnstructured(ut.VirtualServiceGVK, "payments", map[string]interface{}{
+					"hosts": []interface{}{"payments"},
+					"http": []interface{}{
+						map[string]interface{}{
+							"route": []interface{}{
+								map[string]interface{}{"destination": map[string]interface{}{"host": "payments", "subset": "v1"}, "weight": int64(80)},
+								map[string]interface{}{"destination": map[string]interface{}{"host": "payments", "subset": "v2"}, "weight": int64(20)},
+							},
+						},
+					},
+				}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{Weight: 10}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+				ut.UnstructuredList(ut.DestinationRuleGVK),
+			},
+		},
+		{
+			name:        "deleted copy with shared virtual service",
+			explanation: "should delete the shared VirtualService which has no rules of other forks",
+			initialState: []runtime.Object{
+				ut.AddUnstructuredLabel(ut.AddUnstructuredAnnotation(ut.GenUnstructured(ut.VirtualServiceGVK, "payments-forks", map[string]interface{}{
+					"hosts": []interface{}{"payments"},
+					"http": []interface{}{
+						map[string]interface{}{
+							"name":  "fork-pr-42",
+							"match": []interface{}{map[string]interface{}{"headers": map[string]interface{}{"x-fork": map[string]interface{}{"exact": "pr-42"}}}},
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "payments-pr-42"}}},
+						},
+						map[string]interface{}{
+							"name":  "source",
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "payments"}}},
+						},
+					},
+				}), "duplication.k8s.wantedly.com/owned-rules", `{"DeploymentCopy/some-namespace/some-deployment-copy":[{"match":[{"headers":{"x-fork":{"exact":"pr-42"}}}],"name":"fork-pr-42","route":[{"destination":{"host":"payments-pr-42"}}]}]}`), "duplication.k8s.wantedly.com/shared-route", "true"),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{}),
+					ut.MarkDeleted(),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+			},
+		},
+		{
+			name:        "gateway api",
+			explanation: "should generate an HTTPRoute routing only requests with the header to a clone of the service",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{
+						GatewayAPI: &ddv1beta1.GatewayRouting{
+							ParentRefs: []ddv1beta1.ParentReference{{Name: "some-gateway", Namespace: "gateway-system"}},
+							Hostnames:  []string{"payments.example.com"},
+						},
+					}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.HTTPRouteGVK),
+			},
+		},
+		{
+			name:        "gateway api with weight",
+			explanation: "should report that weight isn't supported by generated HTTPRoutes",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{
+						Weight:     10,
+						GatewayAPI: &ddv1beta1.GatewayRouting{ParentRefs: []ddv1beta1.ParentReference{{Name: "some-gateway"}}},
+					}),
+				),
+			},
+		},
+		{
+			name:        "gateway api existing route",
+			explanation: "should replace rules added before in front of rules for the service, keeping rules owned by others",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.AddUnstructuredAnnotation(ut.GenUnstructured(ut.HTTPRouteGVK, "web", map[string]interface{}{
+					"parentRefs": []interface{}{map[string]interface{}{"name": "some-gateway"}},
+					"rules": []interface{}{
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/payments"}, "headers": []interface{}{map[string]interface{}{"type": "Exact", "name": "x-fork", "value": "old"}}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "payments-old", "port": int64(80), "weight": int64(1)}},
+						},
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/payments"}, "headers": []interface{}{map[string]interface{}{"type": "Exact", "name": "x-fork", "value": "pr-1"}}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "payments-pr-1", "port": int64(80), "weight": int64(1)}},
+						},
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/payments"}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "payments", "port": int64(80), "weight": int64(1)}},
+						},
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/users"}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "users", "port": int64(80), "weight": int64(1)}},
+						},
+					},
+				}), "duplication.k8s.wantedly.com/owned-rules", `{"DeploymentCopy/some-namespace/some-deployment-copy":[{"backendRefs":[{"group":"","kind":"Service","name":"payments-old","port":80,"weight":1}],"matches":[{"headers":[{"name":"x-fork","type":"Exact","value":"old"}],"path":{"type":"PathPrefix","value":"/payments"}}]}],"DeploymentCopy/some-namespace/another-copy":[{"backendRefs":[{"group":"","kind":"Service","name":"payments-pr-1","port":80,"weight":1}],"matches":[{"headers":[{"name":"x-fork","type":"Exact","value":"pr-1"}],"path":{"type":"PathPrefix","value":"/payments"}}]}]}`),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{GatewayAPI: &ddv1beta1.GatewayRouting{HTTPRouteName: "web"}}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.HTTPRouteGVK),
+			},
+		},
+		{
+			name:        "gateway api existing route with weight",
+			explanation: "should send 10% of the other requests to the clone, and keep the split of the rest between the backends",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenUnstructured(ut.HTTPRouteGVK, "web", map[string]interface{}{
+					"parentRefs": []interface{}{map[string]interface{}{"name": "some-gateway"}},
+					"rules": []interface{}{
+						map[string]interface{}{
+							"matches": []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/payments"}}},
+							"backendRefs": []interface{}{
+								map[string]interface{}{"group": "", "kind": "Service", "name": "payments", "port": int64(80), "weight": int64(3)},
+								map[string]interface{}{"group": "", "kind": "Service", "name": "payments-legacy", "port": int64(80), "weight": int64(1)},
+							},
+						},
+					},
+				}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{Weight: 10, GatewayAPI: &ddv1beta1.GatewayRouting{HTTPRouteName: "web"}}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.HTTPRouteGVK),
+			},
+		},
+		{
+			name:        "deleted copy with existing route",
+			explanation: "should remove rules added to the existing route and the finalizer",
+			initialState: []runtime.Object{
+				ut.AddUnstructuredAnnotation(ut.GenUnstructured(ut.HTTPRouteGVK, "web", map[string]interface{}{
+					"rules": []interface{}{
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/"}, "headers": []interface{}{map[string]interface{}{"type": "Exact", "name": "x-fork", "value": "pr-42"}}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "payments-pr-42", "port": int64(80), "weight": int64(1)}},
+						},
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/"}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "payments", "port": int64(80), "weight": int64(1)}},
+						},
+					},
+				}), "duplication.k8s.wantedly.com/owned-rules", `{"DeploymentCopy/some-namespace/some-deployment-copy":[{"backendRefs":[{"group":"","kind":"Service","name":"payments-pr-42","port":80,"weight":1}],"matches":[{"headers":[{"name":"x-fork","type":"Exact","value":"pr-42"}],"path":{"type":"PathPrefix","value":"/"}}]}]}`),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetRouting(ddv1beta1.Routing{GatewayAPI: &ddv1beta1.GatewayRouting{HTTPRouteName: "web"}}),
+					ut.MarkDeleted(),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.HTTPRouteGVK),
+			},
+		},
+		{
+			name:        "ingress",
+			explanation: "should clone ingresses routing to the service with rewritten hosts and list their URLs",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenService("users", map[string]string{"app": "users"}),
+				ut.GenIngress("api", []string{"payments.api.qa.example.com", "users.api.qa.example.com"}, []string{"payments", "users"}, true),
+				ut.GenIngress("admin", []string{"admin.qa.example.com"}, []string{"payments"}, false),
+				ut.GenIngress("users", []string{"users.qa.example.com"}, []string{"users"}, false),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetIngress("{{ .NameSuffix }}-{{ .Host }}"),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&networkingv1.IngressList{},
+			},
+		},
+		{
+			name:        "ingress with cert-manager",
+			explanation: "should drop the secret of the certificate and annotations of cert-manager, since the certificate is for the original hosts",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.AddIngressAnnotation(ut.AddIngressAnnotation(ut.GenIngress("api", []string{"payments.api.qa.example.com"}, []string{"payments"}, true),
+					"cert-manager.io/cluster-issuer", "letsencrypt"), "nginx.ingress.kubernetes.io/proxy-body-size", "8m"),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetIngress(""),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&networkingv1.IngressList{},
+			},
+		},
+		{
+			name:        "ingress with the original host",
+			explanation: "should refuse to clone ingresses when hostTemplate rewrites a host to a host of the originals",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenIngress("api", []string{"payments.api.qa.example.com"}, []string{"payments"}, false),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.SetIngress("{{ .Host }}"),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&networkingv1.IngressList{},
+			},
+		},
+		{
+			name:        "autoscalers",
+			explanation: "should clone HPAs and PDBs of the original deployment with overridden bounds and rewritten selectors",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenHorizontalPodAutoscaler("payments", "payments", 3, 10),
+				ut.GenHorizontalPodAutoscaler("users", "users", 2, 5),
+				ut.GenPodDisruptionBudget("payments", map[string]string{"app": "payments"}, intstr.FromInt(2)),
+				ut.GenPodDisruptionBudget("users", map[string]string{"app": "users"}, intstr.FromInt(1)),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.EnableIsolation(),
+					ut.SetHorizontalPodAutoscaler(pointer.Int32(1), nil),
+					ut.SetPodDisruptionBudget(&maxUnavailable),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&autoscalingv2.HorizontalPodAutoscalerList{},
+				&policyv1.PodDisruptionBudgetList{},
+			},
+		},
+		{
+			name:        "autoscalersRaisedMax",
+			explanation: "should raise maxReplicas of the cloned HPA to minReplicas and keep minAvailable of the PDB",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenHorizontalPodAutoscaler("payments", "payments", 1, 3),
+				ut.GenPodDisruptionBudget("payments", map[string]string{"app": "payments"}, intstr.FromString("50%")),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetHorizontalPodAutoscaler(pointer.Int32(5), nil),
+					ut.SetPodDisruptionBudget(nil),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&autoscalingv2.HorizontalPodAutoscalerList{},
+				&policyv1.PodDisruptionBudgetList{},
+			},
+		},
+		{
+			name:        "canaryWeight",
+			explanation: "should scale the copy to 25% of ready pods in total, ignoring replicas",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(10)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetReplicas(5),
+					ut.SetCanaryWeight(25),
+				),
+			},
+		},
+		{
+			name:        "canaryWeight without ready pods of the original",
+			explanation: "should scale the copy to zero so that it doesn't take all of the traffic",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetCanaryWeight(25),
+				),
+			},
+		},
+		{
+			name:        "canarySteps start",
+			explanation: "should start at the first step with a single replica",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(10)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetCanarySteps(
+						ddv1beta1.CanaryStep{Replicas: pointer.Int32(1), Pause: &metav1.Duration{Duration: 10 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio25, Pause: &metav1.Duration{Duration: 30 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio50},
+					),
+				),
+			},
+		},
+		{
+			name:        "canarySteps advance",
+			explanation: "should move to the second step after its pause and scale to 25% of ready pods",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(10)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetCanarySteps(
+						ddv1beta1.CanaryStep{Replicas: pointer.Int32(1), Pause: &metav1.Duration{Duration: 10 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio25, Pause: &metav1.Duration{Duration: 30 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio50},
+					),
+					ut.SetCanaryStatus(0, time.Date(2021, 12, 31, 23, 45, 0, 0, time.UTC)),
+				),
+			},
+		},
+		{
+			name:        "canarySteps paused",
+			explanation: "should record when the progression was paused and stay at the current step",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(10)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetCanarySteps(
+						ddv1beta1.CanaryStep{Replicas: pointer.Int32(1), Pause: &metav1.Duration{Duration: 10 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio25, Pause: &metav1.Duration{Duration: 30 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio50},
+					),
+					ut.SetCanaryStatus(0, time.Date(2021, 12, 31, 23, 45, 0, 0, time.UTC)),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/canary-paused", "true"),
+				),
+			},
+		},
+		{
+			name:        "canarySteps aborted",
+			explanation: "should scale the copy to zero",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetReadyStatus(10)),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetCanarySteps(
+						ddv1beta1.CanaryStep{Replicas: pointer.Int32(1), Pause: &metav1.Duration{Duration: 10 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio25, Pause: &metav1.Duration{Duration: 30 * time.Minute}},
+						ddv1beta1.CanaryStep{ReplicaRatio: &ratio50},
+					),
+					ut.SetCanaryStatus(1, time.Date(2021, 12, 31, 23, 45, 0, 0, time.UTC)),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/canary-aborted", "true"),
+				),
+			},
+		},
+		{
+			name:        "analysis healthy",
+			explanation: "should report the copy is healthy when all metrics are within thresholds",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetAnalysis(
+						ddv1beta1.AnalysisMetric{Name: "error-rate", Query: `error_rate{namespace="{{ .Namespace }}",deployment="{{ .Name }}"}`, Max: "0.01"},
+						ddv1beta1.AnalysisMetric{Name: "latency", Query: `latency{deployment="{{ .Name }}"} / latency{deployment="{{ .Source }}"}`, Min: "0", Max: "1.5"},
+					),
+				),
+			},
+			metrics: map[string]string{
+				`error_rate{namespace="some-namespace",deployment="some-deployment-some-deployment-copy"}`:           "0.001",
+				`latency{deployment="some-deployment-some-deployment-copy"} / latency{deployment="some-deployment"}`: "1.2",
+			},
+		},
+		{
+			name:        "analysis degraded",
+			explanation: "should report metrics beyond thresholds and queries which failed",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetAnalysis(
+						ddv1beta1.AnalysisMetric{Name: "error-rate", Query: `error_rate{namespace="{{ .Namespace }}",deployment="{{ .Name }}"}`, Max: "0.01"},
+						ddv1beta1.AnalysisMetric{Name: "latency", Query: `latency{deployment="{{ .Name }}"} / latency{deployment="{{ .Source }}"}`, Min: "0", Max: "1.5"},
+					),
+				),
+			},
+			metrics: map[string]string{
+				`error_rate{namespace="some-namespace",deployment="some-deployment-some-deployment-copy"}`: "0.05",
+			},
+		},
+		{
+			name:        "analysis inconclusive",
+			explanation: "should report the health is unknown when a query returns NaN, e.g. without requests",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetAnalysis(
+						ddv1beta1.AnalysisMetric{Name: "error-rate", Query: `error_rate{namespace="{{ .Namespace }}",deployment="{{ .Name }}"}`, Max: "0.01"},
+					),
+				),
+			},
+			metrics: map[string]string{
+				`error_rate{namespace="some-namespace",deployment="some-deployment-some-deployment-copy"}`: "NaN",
+			},
+		},
+		{
+			name:        "promote",
+			explanation: "should apply the image and env of the copy to the original deployment, record Events and keep the copy",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar-image-tag"), ut.AddEnv("some-container", "LOG_LEVEL", "info")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddTargetEnv("some-container", "LOG_LEVEL", "debug"),
+					ut.AddTargetEnv("some-container", "FEATURE_X", "enabled"),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/promote", "true"),
+					ut.AddCreator("some-user", "some-group"),
+				),
+			},
+		},
+		{
+			name:        "promote and suspend",
+			explanation: "should promote the copy and scale it to zero",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar-image-tag"), ut.AddEnv("some-container", "LOG_LEVEL", "info")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddTargetEnv("some-container", "LOG_LEVEL", "debug"),
+					ut.AddTargetEnv("some-container", "FEATURE_X", "enabled"),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/promote", "true"),
+					ut.AddCreator("some-user", "some-group"),
+					ut.SetAfterPromotion(ddv1beta1.PromotionSuspend),
+				),
+			},
+		},
+		{
+			name:        "promote and delete",
+			explanation: "should promote the copy and delete the DeploymentCopy. The copied deployment is left to the garbage collector",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar-image-tag"), ut.AddEnv("some-container", "LOG_LEVEL", "info")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddTargetEnv("some-container", "LOG_LEVEL", "debug"),
+					ut.AddTargetEnv("some-container", "FEATURE_X", "enabled"),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/promote", "true"),
+					ut.AddCreator("some-user", "some-group"),
+					ut.SetAfterPromotion(ddv1beta1.PromotionDelete),
+				),
+			},
+		},
+		{
+			name:        "promote without update access",
+			explanation: "should keep the original deployment in the source namespace and report that the creator may not update it",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/promote", "true"),
+					ut.AddSourceNamespace("source-namespace"),
+					ut.AddCreator("some-user", "some-group"),
+				),
+			},
+			denied: []string{"update deployments"},
+		},
+		{
+			name:        "promote without webhook",
+			explanation: "should promote to the original deployment in the same namespace, whose creator doesn't have to be checked",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddCopyAnnotation("duplication.k8s.wantedly.com/promote", "true"),
+				),
+			},
+			webhookDisabled: true,
+		},
+		{
+			name:        "failurePolicy scaleToZero",
+			explanation: "should scale the copy to zero when its pod is in CrashLoopBackOff, ignoring pods of the original",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetUID()),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "fork": "pr-42"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetUID()),
+				ut.GenReplicaSet("some-deployment-12345", map[string]string{"app": "some-app"}, "some-deployment"),
+				ut.GenReplicaSet("some-deployment-some-deployment-copy-12345", map[string]string{"app": "some-app", "fork": "pr-42"}, "some-deployment-some-deployment-copy"),
+				ut.GenPod("some-deployment-12345-abcde", map[string]string{"app": "some-app"}, ut.OwnedByReplicaSet("some-deployment-12345"), ut.AddContainerStatus("some-container", 10, "")),
+				ut.GenPod("some-deployment-some-deployment-copy-12345-abcde", map[string]string{"app": "some-app", "fork": "pr-42"}, ut.OwnedByReplicaSet("some-deployment-some-deployment-copy-12345"), ut.AddContainerStatus("some-container", 3, "CrashLoopBackOff")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetFailurePolicy(ddv1beta1.FailureScaleToZero, nil),
+				),
+			},
+		},
+		{
+			name:        "failurePolicy revert",
+			explanation: "should revert the spec to the last healthy one when a container restarted too many times",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "fork": "pr-42"}, ut.AddContainer("some-container", "broken-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetUID()),
+				ut.GenReplicaSet("some-deployment-some-deployment-copy-12345", map[string]string{"app": "some-app", "fork": "pr-42"}, "some-deployment-some-deployment-copy"),
+				ut.GenPod("some-deployment-some-deployment-copy-12345-abcde", map[string]string{"app": "some-app", "fork": "pr-42"}, ut.OwnedByReplicaSet("some-deployment-some-deployment-copy-12345"), ut.AddContainerStatus("some-container", 4, "")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "broken-image-tag"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetFailurePolicy(ddv1beta1.FailureRevert, pointer.Int32(3)),
+					ut.SetLastHealthySpec(ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+						ut.AddTargetContainer("some-container", "another-image-tag"),
+						ut.AddCustomLabel("fork", "pr-42"),
+						ut.SetFailurePolicy(ddv1beta1.FailureRevert, pointer.Int32(3)),
+					).Spec),
+				),
+			},
+		},
+		{
+			name:        "failurePolicy healthy",
+			explanation: "should record the spec as the last healthy one when the copy is ready without failures",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app", "fork": "pr-42"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetReadyStatus(1), ut.SetUID()),
+				ut.GenReplicaSet("some-deployment-some-deployment-copy-12345", map[string]string{"app": "some-app", "fork": "pr-42"}, "some-deployment-some-deployment-copy"),
+				ut.GenPod("some-deployment-some-deployment-copy-12345-abcde", map[string]string{"app": "some-app", "fork": "pr-42"}, ut.OwnedByReplicaSet("some-deployment-some-deployment-copy-12345"), ut.AddContainerStatus("some-container", 1, "")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.AddCustomLabel("fork", "pr-42"),
+					ut.SetFailurePolicy(ddv1beta1.FailureRevert, pointer.Int32(3)),
+					ut.SetCopyStatus(true, 1, 1),
+				),
+			},
+		},
+		{
+			name:        "failurePolicy with the selector of the original",
+			explanation: "should ignore failing pods of the original even when the copy, made before the fork label was added, has the same selector",
+			initialState: []runtime.Object{
+				ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetUID()),
+				ut.GenDeployment("some-deployment-some-deployment-copy", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy"), ut.SetUID()),
+				ut.GenReplicaSet("some-deployment-12345", map[string]string{"app": "some-app"}, "some-deployment"),
+				ut.GenReplicaSet("some-deployment-some-deployment-copy-12345", map[string]string{"app": "some-app"}, "some-deployment-some-deployment-copy"),
+				ut.GenPod("some-deployment-12345-abcde", map[string]string{"app": "some-app"}, ut.OwnedByReplicaSet("some-deployment-12345"), ut.AddContainerStatus("some-container", 3, "CrashLoopBackOff")),
+				ut.GenPod("some-deployment-some-deployment-copy-12345-abcde", map[string]string{"app": "some-app"}, ut.OwnedByReplicaSet("some-deployment-some-deployment-copy-12345"), ut.AddContainerStatus("some-container", 0, "")),
+				ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetFailurePolicy(ddv1beta1.FailureScaleToZero, nil),
+				),
+			},
+		},
+		{
+			name:        "isolation",
+			explanation: "should rewrite labels selected by services of the original and report services still selecting the copy",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments", map[string]string{"app": "payments", "tier": "backend", "team": "money"}, ut.AddContainer("app", "payments:latest")),
+				ut.GenService("payments", map[string]string{"app": "payments"}),
+				ut.GenService("backends", map[string]string{"tier": "backend"}),
+				ut.GenService("canaries", map[string]string{"canary": "true"}),
+				ut.GenDeploymentCopy("some-deployment-copy", "payments",
+					ut.SetNameSuffix("pr-42"),
+					ut.AddCustomLabel("canary", "true"),
+					ut.EnableIsolation(),
+					ut.EnableServiceRewrite(),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+			},
+		},
+		{
+			name:        "targetSelector",
+			explanation: "should make a copy of each matching deployment and delete copies of deployments which stopped matching",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments-api", map[string]string{"app": "payments", "role": "api"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("payments-worker", map[string]string{"app": "payments", "role": "worker"}, ut.AddContainer("some-container", "some-image-tag"), ut.AddContainer("sidecar", "sidecar-image-tag")),
+				ut.GenDeployment("users-api", map[string]string{"app": "users", "role": "api"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("users-api-some-deployment-copy", map[string]string{"app": "users", "role": "api"}, ut.AddContainer("some-container", "another-image-tag"), ut.OwnedBy("some-deployment-copy")),
+				ut.GenDeploymentCopy("some-deployment-copy", "",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetTargetSelector(map[string]string{"app": "payments"}),
+				),
+			},
+		},
+		{
+			name:        "targetSelector with an orphaned copy",
+			explanation: "should not copy deployments orphaned by a deleted DeploymentCopy, which keep labels of their originals",
+			initialState: []runtime.Object{
+				ut.GenDeployment("payments-api", map[string]string{"app": "payments", "role": "api"}, ut.AddContainer("some-container", "some-image-tag")),
+				ut.GenDeployment("payments-api-old-copy", map[string]string{"app": "payments", "role": "api"}, ut.AddContainer("some-container", "old-image-tag"), ut.AddLabel("duplication.k8s.wantedly.com/orphaned-from", "old-copy")),
+				ut.GenDeploymentCopy("some-deployment-copy", "",
+					ut.AddTargetContainer("some-container", "another-image-tag"),
+					ut.SetTargetSelector(map[string]string{"app": "payments"}),
+				),
+			},
+		},
 	}
 
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
 			client := fake.NewFakeClientWithScheme(scheme, tc.initialState...)
 
+			recorder := record.NewFakeRecorder(100)
+
+			var metrics controllers.MetricsProvider
+			if tc.metrics != nil {
+				server := httptest.NewServer(ut.PrometheusStub(tc.metrics))
+				defer server.Close()
+				metrics = &controllers.PrometheusClient{Address: server.URL}
+			}
+
 			rec := controllers.DeploymentCopyReconciler{
-				Client: client,
-				Log:    ctrl.Log,
-				Scheme: scheme,
+				Client:         ut.WithAccessReviews(ut.WithServerSideApply(ut.WithStatusSubresource(client)), tc.denied...),
+				Log:            ctrl.Log,
+				Scheme:         scheme,
+				Clock:          clocktesting.NewFakePassiveClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+				Metrics:        metrics,
+				Recorder:       recorder,
+				CreatorWebhook: !tc.webhookDisabled,
 			}
 
 			ctx := context.Background()
@@ -113,6 +1208,7 @@ func TestDeploymentCopyReconciler(t *testing.T) {
 				&ddv1beta1.DeploymentCopyList{},
 				&appsv1.DeploymentList{},
 			}
+			lists = append(lists, tc.lists...)
 
 			for _, ls := range lists {
 				if err := client.List(ctx, ls); err != nil {
@@ -123,7 +1219,96 @@ func TestDeploymentCopyReconciler(t *testing.T) {
 			for i, ls := range lists {
 				ifs[i] = ls
 			}
+			if events := ut.DrainEvents(recorder); len(events) > 0 {
+				ifs = append(ifs, map[string][]string{"events": events})
+			}
 			ut.SnapshotYaml(t, ifs...)
 		})
 	}
 }
+
+func TestDeploymentCopyReconcilerSourceAccess(t *testing.T) {
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{ddv1beta1.AddToScheme, clientgoscheme.AddToScheme, ut.AddIstioToScheme, ut.AddGatewayAPIToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	maxUnavailable := intstr.FromInt(1)
+	istio := ddv1beta1.Routing{Header: "x-fork"}
+	gatewayAPI := ddv1beta1.Routing{Header: "x-fork", GatewayAPI: &ddv1beta1.GatewayRouting{}}
+	existingRoute := ddv1beta1.Routing{Header: "x-fork", GatewayAPI: &ddv1beta1.GatewayRouting{HTTPRouteName: "some-route"}}
+
+	// every kind is generated, so that each denied access prevents the copy
+	cases := []struct {
+		denied  string
+		routing ddv1beta1.Routing
+	}{
+		{"create deployments", istio},
+		{"create configmaps", istio},
+		{"update configmaps", istio},
+		{"create secrets", istio},
+		{"update secrets", istio},
+		{"create services", istio},
+		{"update services", istio},
+		{"create ingresses", istio},
+		{"update ingresses", istio},
+		{"create horizontalpodautoscalers", istio},
+		{"update horizontalpodautoscalers", istio},
+		{"create poddisruptionbudgets", istio},
+		{"update poddisruptionbudgets", istio},
+		{"create destinationrules", istio},
+		{"update destinationrules", istio},
+		{"create virtualservices", istio},
+		{"update virtualservices", istio},
+		{"create httproutes", gatewayAPI},
+		{"update httproutes", gatewayAPI},
+		{"update httproutes", existingRoute},
+	}
+
+	for _, tc := range cases {
+		client := fake.NewFakeClientWithScheme(scheme,
+			ut.GenDeployment("some-deployment", map[string]string{"app": "some-app"}, ut.AddContainer("some-container", "some-image-tag"), ut.SetNamespace("source-namespace")),
+			ut.GenDeploymentCopy("some-deployment-copy", "some-deployment",
+				ut.AddTargetContainer("some-container", "another-image-tag"),
+				ut.AddSourceNamespace("source-namespace"),
+				ut.AddCreator("some-user", "some-group"),
+				ut.EnableServiceRewrite(),
+				ut.SetIngress("{{ .NameSuffix }}.{{ .Host }}"),
+				ut.SetHorizontalPodAutoscaler(nil, nil),
+				ut.SetPodDisruptionBudget(&maxUnavailable),
+				ut.SetRouting(tc.routing),
+			),
+		)
+		rec := controllers.DeploymentCopyReconciler{
+			Client:         ut.WithAccessReviews(ut.WithServerSideApply(ut.WithStatusSubresource(client)), tc.denied),
+			Log:            ctrl.Log,
+			Scheme:         scheme,
+			Clock:          clocktesting.NewFakePassiveClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+			Recorder:       record.NewFakeRecorder(100),
+			CreatorWebhook: true,
+		}
+
+		ctx := context.Background()
+		nn := types.NamespacedName{Namespace: "some-namespace", Name: "some-deployment-copy"}
+		if _, err := rec.Reconcile(ctx, ctrl.Request{NamespacedName: nn}); err != nil {
+			t.Fatalf("%s: %+v", tc.denied, err)
+		}
+
+		instance := &ddv1beta1.DeploymentCopy{}
+		if err := client.Get(ctx, nn, instance); err != nil {
+			t.Fatalf("%s: %+v", tc.denied, err)
+		}
+		if !meta.IsStatusConditionFalse(instance.Status.Conditions, ddv1beta1.ConditionSourceAuthorized) {
+			t.Errorf("%s: the copy is authorized, conditions: %v", tc.denied, instance.Status.Conditions)
+		}
+		deployments := &appsv1.DeploymentList{}
+		if err := client.List(ctx, deployments, ctrlclient.InNamespace("source-namespace")); err != nil {
+			t.Fatalf("%s: %+v", tc.denied, err)
+		}
+		if len(deployments.Items) != 1 {
+			t.Errorf("%s: the original is copied", tc.denied)
+		}
+	}
+}
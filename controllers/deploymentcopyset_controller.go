@@ -0,0 +1,189 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// DeploymentCopySetReconciler reconciles a DeploymentCopySet object
+type DeploymentCopySetReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// Clock is used to record transition times of conditions. The real clock is used when nil
+	Clock clock.PassiveClock
+}
+
+//+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=deploymentcopysets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=deploymentcopysets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=deploymentcopysets/finalizers,verbs=update
+
+// Reconcile generates a DeploymentCopy for each member of a DeploymentCopySet and aggregates their readiness
+func (r *DeploymentCopySetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	instance := &duplicationv1beta1.DeploymentCopySet{}
+	err := r.Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	original := instance.Status.DeepCopy()
+	err = r.reconcileSet(ctx, instance)
+	if !equality.Semantic.DeepEqual(original, &instance.Status) {
+		if updateErr := r.Status().Update(ctx, instance); updateErr != nil && err == nil {
+			err = errors.WithStack(updateErr)
+		}
+	}
+	return reconcile.Result{}, err
+}
+
+func (r *DeploymentCopySetReconciler) reconcileSet(ctx context.Context, instance *duplicationv1beta1.DeploymentCopySet) error {
+	copies := make([]client.Object, 0, len(instance.Spec.Members))
+	for _, member := range instance.Spec.Members {
+		copies = append(copies, renderMember(instance, member))
+	}
+	unowned, err := unownedCopies(ctx, r.Client, instance, copies)
+	if err != nil {
+		return err
+	}
+	applied := make([]client.Object, 0, len(copies))
+	for _, obj := range copies {
+		if !unowned[obj.GetName()] {
+			applied = append(applied, obj)
+		}
+	}
+
+	log.Info("try to refresh DeploymentCopies of DeploymentCopySet", "namespace", instance.Namespace, "name", instance.Name, "members", len(applied))
+	err = newApplier(r.Client, r.Scheme, instance.Namespace).Apply(ctx, instance, objectList{
+		Items:            applied,
+		GroupVersionKind: duplicationv1beta1.GroupVersion.WithKind("DeploymentCopy"),
+		Identity:         identityByName,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	members := make([]duplicationv1beta1.DeploymentCopySetMemberStatus, 0, len(instance.Spec.Members))
+	var readyMembers int32
+	var conflicts []string
+	for i, member := range instance.Spec.Members {
+		if unowned[copies[i].GetName()] {
+			conflicts = append(conflicts, copies[i].GetName())
+			members = append(members, duplicationv1beta1.DeploymentCopySetMemberStatus{
+				TargetDeploymentName: member.TargetDeploymentName,
+				DeploymentCopyName:   copies[i].GetName(),
+			})
+			continue
+		}
+		found := &duplicationv1beta1.DeploymentCopy{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(copies[i]), found); err != nil {
+			return errors.WithStack(err)
+		}
+		ready := meta.IsStatusConditionTrue(found.Status.Conditions, duplicationv1beta1.ConditionReady)
+		if ready {
+			readyMembers++
+		}
+		members = append(members, duplicationv1beta1.DeploymentCopySetMemberStatus{
+			TargetDeploymentName: member.TargetDeploymentName,
+			DeploymentCopyName:   found.Name,
+			Ready:                ready,
+			Replicas:             found.Status.Replicas,
+			ReadyReplicas:        found.Status.ReadyReplicas,
+		})
+	}
+	instance.Status.Members = members
+	instance.Status.ReadyMembers = readyMembers
+
+	condition := metav1.Condition{
+		Type:               duplicationv1beta1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.Generation,
+		LastTransitionTime: r.now(),
+		Reason:             "MembersReady",
+	}
+	if len(conflicts) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "MemberConflict"
+		condition.Message = fmt.Sprintf("DeploymentCopies %s already exist and aren't owned by the set", strings.Join(conflicts, ", "))
+	} else if int(readyMembers) < len(members) {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "MembersNotReady"
+		condition.Message = fmt.Sprintf("%d/%d members are ready", readyMembers, len(members))
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	return nil
+}
+
+// renderMember builds a DeploymentCopy for member, sharing the suffix and overrides of instance
+func renderMember(instance *duplicationv1beta1.DeploymentCopySet, member duplicationv1beta1.DeploymentCopySetMember) *duplicationv1beta1.DeploymentCopy {
+	suffix := instance.Spec.NameSuffix
+	if suffix == "" {
+		suffix = instance.Name
+	}
+
+	return &duplicationv1beta1.DeploymentCopy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%s", instance.Name, member.TargetDeploymentName),
+			Namespace: instance.Namespace,
+		},
+		Spec: duplicationv1beta1.DeploymentCopySpec{
+			CustomLabels:             instance.Spec.CustomLabels,
+			CustomAnnotations:        instance.Spec.CustomAnnotations,
+			Replicas:                 member.Replicas,
+			TargetDeploymentName:     member.TargetDeploymentName,
+			Hostname:                 instance.Spec.Hostname,
+			NameSuffix:               suffix,
+			TargetContainers:         member.TargetContainers,
+			ConfigOverrides:          member.ConfigOverrides,
+			RewriteServiceReferences: instance.Spec.RewriteServiceReferences,
+			Routing:                  instance.Spec.Routing,
+			Ingress:                  instance.Spec.Ingress,
+			Isolation:                instance.Spec.Isolation,
+		},
+	}
+}
+
+func (r *DeploymentCopySetReconciler) now() metav1.Time {
+	return clockNow(r.Clock)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DeploymentCopySetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&duplicationv1beta1.DeploymentCopySet{}).
+		Owns(&duplicationv1beta1.DeploymentCopy{}).
+		Complete(r)
+}
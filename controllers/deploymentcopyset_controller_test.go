@@ -0,0 +1,117 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ddv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/wantedly/deployment-duplicator/controllers"
+	ut "github.com/wantedly/deployment-duplicator/controllers/testing"
+)
+
+func TestDeploymentCopySetReconciler(t *testing.T) {
+	scheme := runtime.NewScheme()
+
+	regs := []func(*runtime.Scheme) error{
+		ddv1beta1.AddToScheme,
+		clientgoscheme.AddToScheme,
+	}
+
+	for _, add := range regs {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []testcase{
+		{
+			name:         "no resources",
+			explanation:  "do nothing",
+			initialState: nil,
+		},
+		{
+			name:        "new set",
+			explanation: "should make a DeploymentCopy for each member with the same suffix",
+			initialState: []runtime.Object{
+				ut.GenDeploymentCopySet("some-set",
+					ut.SetSetNameSuffix("fork-xyz"),
+					ut.AddMember("payments", "app", "payments:xyz"),
+					ut.AddMember("users", "app", "users:xyz"),
+				),
+			},
+		},
+		{
+			name:        "existing set",
+			explanation: "should aggregate readiness of members and delete DeploymentCopies of removed members",
+			initialState: []runtime.Object{
+				ut.GenDeploymentCopySet("some-set",
+					ut.AddMember("payments", "app", "payments:xyz"),
+					ut.AddMember("users", "app", "users:xyz"),
+				),
+				ut.GenDeploymentCopy("some-set-payments", "payments", ut.OwnedBySet("some-set"), ut.SetCopyStatus(true, 1, 1)),
+				ut.GenDeploymentCopy("some-set-users", "users", ut.OwnedBySet("some-set"), ut.SetCopyStatus(false, 2, 1)),
+				ut.GenDeploymentCopy("some-set-orders", "orders", ut.OwnedBySet("some-set"), ut.SetCopyStatus(true, 1, 1)),
+			},
+		},
+		{
+			name:        "member taken by another DeploymentCopy",
+			explanation: "should leave a DeploymentCopy which isn't owned by the set alone and report it",
+			initialState: []runtime.Object{
+				ut.GenDeploymentCopySet("some-set",
+					ut.AddMember("payments", "app", "payments:xyz"),
+					ut.AddMember("users", "app", "users:xyz"),
+				),
+				ut.GenDeploymentCopy("some-set-users", "users", ut.AddTargetContainer("app", "users:mine")),
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewFakeClientWithScheme(scheme, tc.initialState...)
+
+			rec := controllers.DeploymentCopySetReconciler{
+				Client: ut.WithServerSideApply(ut.WithStatusSubresource(client)),
+				Log:    ctrl.Log,
+				Scheme: scheme,
+				Clock:  clocktesting.NewFakePassiveClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+			}
+
+			ctx := context.Background()
+			nn := types.NamespacedName{
+				Namespace: "some-namespace",
+				Name:      "some-set",
+			}
+			req := ctrl.Request{NamespacedName: nn}
+			if _, err := rec.Reconcile(ctx, req); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			lists := []ctrlclient.ObjectList{
+				&ddv1beta1.DeploymentCopySetList{},
+				&ddv1beta1.DeploymentCopyList{},
+			}
+			lists = append(lists, tc.lists...)
+
+			for _, ls := range lists {
+				if err := client.List(ctx, ls); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+			ifs := make([]interface{}, len(lists))
+			for i, ls := range lists {
+				ifs[i] = ls
+			}
+			ut.SnapshotYaml(t, ifs...)
+		})
+	}
+}
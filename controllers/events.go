@@ -0,0 +1,155 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// specHashAnnotation records the hash of the rendered spec of a copied deployment,
+// so that changes by the controller can be told from changes by others
+const specHashAnnotation = "duplication.k8s.wantedly.com/spec-hash"
+
+// deploymentChange is how a copied deployment is going to be changed by refreshing it
+type deploymentChange struct {
+	name     string
+	existing *appsv1.Deployment
+	reason   string
+	// message is recorded on the DeploymentCopy, and copyMessage is recorded on the copied deployment
+	message     string
+	copyMessage string
+}
+
+// setSpecHash records the hash of the spec of copied in its annotations
+func setSpecHash(copied *appsv1.Deployment) {
+	if copied.Annotations == nil {
+		copied.Annotations = map[string]string{}
+	}
+	copied.Annotations[specHashAnnotation] = specHash(copied)
+}
+
+func specHash(d *appsv1.Deployment) string {
+	// Marshaling a DeploymentSpec never fails
+	data, _ := json.Marshal(d.Spec)
+	hasher := fnv.New32a()
+	hasher.Write(data)
+	return fmt.Sprintf("%08x", hasher.Sum32())
+}
+
+// detectChanges compares copiedDeploys with the existing ones before they are refreshed, and returns the copies to apply.
+// Existing copies whose selectors differ are deleted, because selectors of Deployments are immutable.
+// Deployments not owned by instance aren't deleted but reported as conflicts of a, and left out of the returned copies
+func (r *DeploymentCopyReconciler) detectChanges(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, a *applier, copiedDeploys []client.Object) ([]deploymentChange, []client.Object, error) {
+	changes := make([]deploymentChange, 0, len(copiedDeploys))
+	applied := make([]client.Object, 0, len(copiedDeploys))
+	for _, obj := range copiedDeploys {
+		copied := obj.(*appsv1.Deployment)
+		change := deploymentChange{name: copied.Name}
+
+		existing := &appsv1.Deployment{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(copied), existing); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, nil, errors.WithStack(err)
+			}
+			change.reason = "Created"
+			change.message = fmt.Sprintf("created Deployment %s", copied.Name)
+			change.copyMessage = "created by DeploymentCopy %s"
+			changes = append(changes, change)
+			applied = append(applied, copied)
+			continue
+		}
+		change.existing = existing
+
+		selectorChanged := !equality.Semantic.DeepEqual(existing.Spec.Selector, copied.Spec.Selector)
+		if selectorChanged && !a.owns(instance, existing) {
+			a.conflicts = append(a.conflicts, duplicationv1beta1.ApplyConflict{
+				Kind:    "Deployment",
+				Name:    copied.Name,
+				Message: "the selector of the existing Deployment differs, and it isn't owned by the DeploymentCopy, so it can't be recreated",
+			})
+			continue
+		}
+
+		switch {
+		case selectorChanged:
+			if err := r.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+				return nil, nil, errors.WithStack(err)
+			}
+			change.existing = nil
+			change.reason = "Recreated"
+			change.message = fmt.Sprintf("recreated Deployment %s because its selector changed", copied.Name)
+			change.copyMessage = "recreated by DeploymentCopy %s because its selector changed"
+		case existing.Annotations[specHashAnnotation] != copied.Annotations[specHashAnnotation]:
+			change.reason = "Updated"
+			change.message = fmt.Sprintf("updated Deployment %s", copied.Name)
+			change.copyMessage = "updated by DeploymentCopy %s"
+		case !equality.Semantic.DeepDerivative(copied.Spec, existing.Spec):
+			change.reason = "DriftReverted"
+			change.message = fmt.Sprintf("reverted changes to Deployment %s made outside of the DeploymentCopy", copied.Name)
+			change.copyMessage = "reverted changes made outside of DeploymentCopy %s"
+		}
+		changes = append(changes, change)
+		applied = append(applied, copied)
+	}
+	return changes, applied, nil
+}
+
+// recordChanges records Events of changes on instance and the copied deployments
+func (r *DeploymentCopyReconciler) recordChanges(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, changes []deploymentChange) error {
+	for _, change := range changes {
+		if change.reason == "" {
+			continue
+		}
+		r.event(instance, corev1.EventTypeNormal, change.reason, change.message)
+		if change.reason == "DriftReverted" {
+			driftReverts.WithLabelValues(namespace).Inc()
+		}
+
+		copied := &appsv1.Deployment{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: change.name}, copied); err != nil {
+			return errors.WithStack(err)
+		}
+		r.event(copied, corev1.EventTypeNormal, change.reason, fmt.Sprintf(change.copyMessage, instance.Namespace+"/"+instance.Name))
+	}
+	return nil
+}
+
+// recordRefreshFailure records an Event of err on instance and the existing copied deployments
+func (r *DeploymentCopyReconciler) recordRefreshFailure(instance *duplicationv1beta1.DeploymentCopy, kind string, changes []deploymentChange, err error) {
+	r.event(instance, corev1.EventTypeWarning, "RefreshFailed", fmt.Sprintf("failed to refresh %ss: %v", kind, err))
+	recordRenderFailure("RefreshFailed")
+	if kind != "Deployment" {
+		return
+	}
+	for _, change := range changes {
+		if change.existing != nil {
+			r.event(change.existing, corev1.EventTypeWarning, "RefreshFailed", fmt.Sprintf("failed to refresh by DeploymentCopy %s/%s: %v", instance.Namespace, instance.Name, err))
+		}
+	}
+}
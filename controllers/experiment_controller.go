@@ -0,0 +1,288 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// ExperimentReconciler reconciles a Experiment object
+type ExperimentReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// Clock is used to record transition times of conditions. The real clock is used when nil
+	Clock clock.PassiveClock
+}
+
+//+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=experiments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=experiments/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=duplication.k8s.wantedly.com,resources=experiments/finalizers,verbs=update
+
+// Reconcile generates a DeploymentCopy for each variant of an Experiment and aggregates their status
+func (r *ExperimentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	instance := &duplicationv1beta1.Experiment{}
+	err := r.Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	if !instance.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, r.finalize(ctx, instance)
+	}
+
+	original := instance.Status.DeepCopy()
+	err = r.reconcileExperiment(ctx, instance)
+	if !equality.Semantic.DeepEqual(original, &instance.Status) {
+		if updateErr := r.Status().Update(ctx, instance); updateErr != nil && err == nil {
+			err = errors.WithStack(updateErr)
+		}
+	}
+	return reconcile.Result{}, err
+}
+
+func (r *ExperimentReconciler) reconcileExperiment(ctx context.Context, instance *duplicationv1beta1.Experiment) error {
+	// Rules added to existing routes aren't owned, so they are removed by the finalizer
+	if injectsRules(instance.Spec.Routing) && !controllerutil.ContainsFinalizer(instance, finalizerName) {
+		controllerutil.AddFinalizer(instance, finalizerName)
+		if err := r.Update(ctx, instance); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var totalWeight int32
+	for _, variant := range instance.Spec.Variants {
+		totalWeight += variant.Weight
+	}
+	// Weights leaving no pods to the original scale all variants to zero and stop routing to them
+	validWeights := totalWeight < 100
+
+	target := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.TargetDeploymentName, Namespace: instance.Namespace}, target); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionFalse, "TargetNotFound", fmt.Sprintf("Deployment %s is not found", instance.Spec.TargetDeploymentName))
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	copies := make([]client.Object, 0, len(instance.Spec.Variants))
+	// Routing is generated by the Experiment, so that rules of all variants are added to routes together.
+	// forks are copies rendered with routing of their variants
+	forks := make([]*duplicationv1beta1.DeploymentCopy, 0, len(instance.Spec.Variants))
+	for _, variant := range instance.Spec.Variants {
+		var replicas int32
+		if validWeights {
+			replicas = variantReplicas(target.Status.ReadyReplicas, variant.Weight, totalWeight)
+		}
+		copies = append(copies, renderVariant(instance, variant, replicas))
+	}
+	unowned, err := unownedCopies(ctx, r.Client, instance, copies)
+	if err != nil {
+		return err
+	}
+	// Variants whose DeploymentCopies are owned by others are neither applied nor routed
+	applied := make([]client.Object, 0, len(copies))
+	for i, variant := range instance.Spec.Variants {
+		if unowned[copies[i].GetName()] {
+			continue
+		}
+		applied = append(applied, copies[i])
+		if !validWeights {
+			continue
+		}
+		fork := copies[i].(*duplicationv1beta1.DeploymentCopy).DeepCopy()
+		fork.Spec.Routing = variantRouting(instance, variant)
+		forks = append(forks, fork)
+	}
+
+	log.Info("try to refresh DeploymentCopies of Experiment", "namespace", instance.Namespace, "name", instance.Name, "variants", len(applied))
+	err = newApplier(r.Client, r.Scheme, instance.Namespace).Apply(ctx, instance, objectList{
+		Items:            applied,
+		GroupVersionKind: duplicationv1beta1.GroupVersion.WithKind("DeploymentCopy"),
+		Identity:         identityByName,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := r.refreshRoutes(ctx, instance, target, forks); err != nil {
+		return err
+	}
+
+	variants := make([]duplicationv1beta1.ExperimentVariantStatus, 0, len(instance.Spec.Variants))
+	var readyVariants int32
+	var conflicts []string
+	for i, variant := range instance.Spec.Variants {
+		if unowned[copies[i].GetName()] {
+			conflicts = append(conflicts, copies[i].GetName())
+			variants = append(variants, duplicationv1beta1.ExperimentVariantStatus{
+				Name:               variant.Name,
+				DeploymentCopyName: copies[i].GetName(),
+			})
+			continue
+		}
+		found := &duplicationv1beta1.DeploymentCopy{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(copies[i]), found); err != nil {
+			return errors.WithStack(err)
+		}
+		ready := meta.IsStatusConditionTrue(found.Status.Conditions, duplicationv1beta1.ConditionReady)
+		if ready {
+			readyVariants++
+		}
+		status := duplicationv1beta1.ExperimentVariantStatus{
+			Name:               variant.Name,
+			DeploymentCopyName: found.Name,
+			Ready:              ready,
+			Replicas:           found.Status.Replicas,
+			ReadyReplicas:      found.Status.ReadyReplicas,
+		}
+		if healthy := meta.FindStatusCondition(found.Status.Conditions, duplicationv1beta1.ConditionHealthy); healthy != nil {
+			status.Healthy = healthy.Status
+		}
+		if found.Status.Analysis != nil {
+			status.AnalysisResults = found.Status.Analysis.Results
+		}
+		variants = append(variants, status)
+	}
+	instance.Status.Variants = variants
+	instance.Status.ReadyVariants = readyVariants
+
+	if !validWeights {
+		message := fmt.Sprintf("the sum of weights is %d, which should be less than 100", totalWeight)
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionFalse, "InvalidWeights", message)
+		if instance.Spec.Routing != nil {
+			r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, "InvalidWeights", message)
+		}
+	} else if len(conflicts) > 0 {
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionFalse, "VariantConflict", fmt.Sprintf("DeploymentCopies %s already exist and aren't owned by the experiment", strings.Join(conflicts, ", ")))
+	} else if int(readyVariants) < len(variants) {
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionFalse, "VariantsNotReady", fmt.Sprintf("%d/%d variants are ready", readyVariants, len(variants)))
+	} else {
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionTrue, "VariantsReady", "")
+	}
+	return nil
+}
+
+// variantReplicas returns replicas of a copy taking weight percent of pods together with sourceReplicas pods of the original
+// and copies of the other variants, which take totalWeight percent with this one.
+// At least one replica is kept so that every variant keeps receiving traffic, unless the original has no ready pods
+func variantReplicas(sourceReplicas, weight, totalWeight int32) int32 {
+	if sourceReplicas == 0 {
+		return 0
+	}
+	replicas := int32(math.Round(float64(sourceReplicas) * float64(weight) / float64(100-totalWeight)))
+	if replicas < 1 {
+		return 1
+	}
+	return replicas
+}
+
+// renderVariant builds a DeploymentCopy for variant with replicas.
+// Zero replicas suspend the copy, since a DeploymentCopy takes replicas of the original when `Replicas` is zero
+func renderVariant(instance *duplicationv1beta1.Experiment, variant duplicationv1beta1.ExperimentVariant, replicas int32) *duplicationv1beta1.DeploymentCopy {
+	name := fmt.Sprintf("%s-%s", instance.Name, variant.Name)
+
+	var annotations map[string]string
+	if replicas == 0 {
+		annotations = map[string]string{suspendedAnnotation: "true"}
+	}
+	return &duplicationv1beta1.DeploymentCopy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   instance.Namespace,
+			Annotations: annotations,
+		},
+		Spec: duplicationv1beta1.DeploymentCopySpec{
+			CustomLabels:         instance.Spec.CustomLabels,
+			CustomAnnotations:    instance.Spec.CustomAnnotations,
+			Replicas:             replicas,
+			TargetDeploymentName: instance.Spec.TargetDeploymentName,
+			NameSuffix:           name,
+			TargetContainers:     variant.TargetContainers,
+			ConfigOverrides:      variant.ConfigOverrides,
+			Analysis:             instance.Spec.Analysis,
+		},
+	}
+}
+
+// experimentsForDeployment maps a Deployment to Experiments on it, so that replicas of variants follow the original
+func (r *ExperimentReconciler) experimentsForDeployment(obj client.Object) []reconcile.Request {
+	experiments := &duplicationv1beta1.ExperimentList{}
+	if err := r.List(context.Background(), experiments, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.Error(err, "failed to list Experiments")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, experiment := range experiments.Items {
+		if experiment.Spec.TargetDeploymentName == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: experiment.Name, Namespace: experiment.Namespace}})
+		}
+	}
+	return requests
+}
+
+func (r *ExperimentReconciler) now() metav1.Time {
+	return clockNow(r.Clock)
+}
+
+func (r *ExperimentReconciler) setCondition(instance *duplicationv1beta1.Experiment, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: instance.Generation,
+		LastTransitionTime: r.now(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ExperimentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&duplicationv1beta1.Experiment{}).
+		Owns(&duplicationv1beta1.DeploymentCopy{}).
+		Owns(&corev1.Service{}).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.experimentsForDeployment)).
+		Complete(r)
+}
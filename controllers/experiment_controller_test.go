@@ -0,0 +1,223 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ddv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/wantedly/deployment-duplicator/controllers"
+	ut "github.com/wantedly/deployment-duplicator/controllers/testing"
+)
+
+func TestExperimentReconciler(t *testing.T) {
+	scheme := runtime.NewScheme()
+
+	regs := []func(*runtime.Scheme) error{
+		ddv1beta1.AddToScheme,
+		clientgoscheme.AddToScheme,
+		ut.AddIstioToScheme,
+		ut.AddGatewayAPIToScheme,
+	}
+
+	for _, add := range regs {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []testcase{
+		{
+			name:         "no resources",
+			explanation:  "do nothing",
+			initialState: nil,
+		},
+		{
+			name:        "new experiment",
+			explanation: "should make a DeploymentCopy for each variant splitting pods by weights, and route requests by variant names to clones of the service",
+			initialState: []runtime.Object{
+				ut.GenDeployment("checkout", map[string]string{"app": "checkout"}, ut.AddContainer("app", "checkout:latest"), ut.SetReadyStatus(8)),
+				ut.GenService("checkout", map[string]string{"app": "checkout"}),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 10, "app", "checkout:a"),
+					ut.AddVariant("b", 10, "app", "checkout:b"),
+					ut.SetExperimentRouting(ddv1beta1.Routing{Header: "x-variant", Value: "ignored", Weight: 50}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+				ut.UnstructuredList(ut.DestinationRuleGVK),
+			},
+		},
+		{
+			name:        "experiment with existing http route",
+			explanation: "should add rules of all variants to the existing HTTPRoute and add the finalizer",
+			initialState: []runtime.Object{
+				ut.GenDeployment("checkout", map[string]string{"app": "checkout"}, ut.AddContainer("app", "checkout:latest"), ut.SetReadyStatus(8)),
+				ut.GenService("checkout", map[string]string{"app": "checkout"}),
+				ut.GenUnstructured(ut.HTTPRouteGVK, "web", map[string]interface{}{
+					"rules": []interface{}{
+						map[string]interface{}{
+							"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/checkout"}}},
+							"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "checkout", "port": int64(80), "weight": int64(1)}},
+						},
+					},
+				}),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 10, "app", "checkout:a"),
+					ut.AddVariant("b", 10, "app", "checkout:b"),
+					ut.SetExperimentRouting(ddv1beta1.Routing{Header: "x-variant", GatewayAPI: &ddv1beta1.GatewayRouting{HTTPRouteName: "web"}}),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.HTTPRouteGVK),
+			},
+		},
+		{
+			name:        "deleted experiment",
+			explanation: "should remove rules of all variants from the shared VirtualService and the finalizer",
+			initialState: []runtime.Object{
+				ut.AddUnstructuredLabel(ut.AddUnstructuredAnnotation(ut.GenUnstructured(ut.VirtualServiceGVK, "checkout-forks", map[string]interface{}{
+					"hosts": []interface{}{"checkout"},
+					"http": []interface{}{
+						map[string]interface{}{
+							"name":  "fork-some-experiment-a",
+							"match": []interface{}{map[string]interface{}{"headers": map[string]interface{}{"x-variant": map[string]interface{}{"exact": "a"}}}},
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "checkout-some-experiment-a"}}},
+						},
+						map[string]interface{}{
+							"name":  "fork-pr-1",
+							"match": []interface{}{map[string]interface{}{"headers": map[string]interface{}{"x-fork": map[string]interface{}{"exact": "pr-1"}}}},
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "checkout-pr-1"}}},
+						},
+						map[string]interface{}{
+							"name":  "source",
+							"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": "checkout"}}},
+						},
+					},
+				}), "duplication.k8s.wantedly.com/owned-rules", `{"Experiment/some-namespace/some-experiment":[{"match":[{"headers":{"x-variant":{"exact":"a"}}}],"name":"fork-some-experiment-a","route":[{"destination":{"host":"checkout-some-experiment-a"}}]}],"DeploymentCopy/some-namespace/another-copy":[{"match":[{"headers":{"x-fork":{"exact":"pr-1"}}}],"name":"fork-pr-1","route":[{"destination":{"host":"checkout-pr-1"}}]}]}`), "duplication.k8s.wantedly.com/shared-route", "true"),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 10, "app", "checkout:a"),
+					ut.SetExperimentRouting(ddv1beta1.Routing{Header: "x-variant"}),
+					ut.MarkExperimentDeleted(),
+				),
+			},
+			lists: []ctrlclient.ObjectList{
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+			},
+		},
+		{
+			name:        "existing experiment",
+			explanation: "should aggregate readiness and analysis of variants and delete DeploymentCopies of removed variants",
+			initialState: []runtime.Object{
+				ut.GenDeployment("checkout", map[string]string{"app": "checkout"}, ut.AddContainer("app", "checkout:latest"), ut.SetReadyStatus(8)),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 10, "app", "checkout:a"),
+					ut.AddVariant("b", 10, "app", "checkout:b"),
+				),
+				ut.GenDeploymentCopy("some-experiment-a", "checkout", ut.OwnedByExperiment("some-experiment"), ut.SetCopyStatus(true, 1, 1),
+					ut.SetCopyAnalysisStatus(metav1.ConditionTrue, ddv1beta1.AnalysisResult{Metric: "error-rate", Deployment: "checkout-some-experiment-a", Value: "0.001", Passed: true}),
+				),
+				ut.GenDeploymentCopy("some-experiment-b", "checkout", ut.OwnedByExperiment("some-experiment"), ut.SetCopyStatus(false, 1, 0)),
+				ut.GenDeploymentCopy("some-experiment-c", "checkout", ut.OwnedByExperiment("some-experiment"), ut.SetCopyStatus(true, 1, 1)),
+			},
+		},
+		{
+			name:        "experiment without ready pods of the original",
+			explanation: "should scale copies of all variants to zero",
+			initialState: []runtime.Object{
+				ut.GenDeployment("checkout", map[string]string{"app": "checkout"}, ut.AddContainer("app", "checkout:latest")),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 10, "app", "checkout:a"),
+				),
+			},
+		},
+		{
+			name:        "variant taken by another DeploymentCopy",
+			explanation: "should leave a DeploymentCopy which isn't owned by the experiment alone, route only to the other variants and report it",
+			initialState: []runtime.Object{
+				ut.GenDeployment("checkout", map[string]string{"app": "checkout"}, ut.AddContainer("app", "checkout:latest"), ut.SetReadyStatus(8)),
+				ut.GenService("checkout", map[string]string{"app": "checkout"}),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 10, "app", "checkout:a"),
+					ut.AddVariant("b", 10, "app", "checkout:b"),
+					ut.SetExperimentRouting(ddv1beta1.Routing{Header: "x-variant"}),
+				),
+				ut.GenDeploymentCopy("some-experiment-b", "checkout", ut.AddTargetContainer("app", "checkout:mine")),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+			},
+		},
+		{
+			name:        "invalid weights",
+			explanation: "should report weights leaving no pods to the original, scale copies of all variants to zero and route no requests to them",
+			initialState: []runtime.Object{
+				ut.GenDeployment("checkout", map[string]string{"app": "checkout"}, ut.AddContainer("app", "checkout:latest"), ut.SetReadyStatus(8)),
+				ut.GenService("checkout", map[string]string{"app": "checkout"}),
+				ut.GenExperiment("some-experiment", "checkout",
+					ut.AddVariant("a", 50, "app", "checkout:a"),
+					ut.AddVariant("b", 50, "app", "checkout:b"),
+					ut.SetExperimentRouting(ddv1beta1.Routing{Header: "x-variant"}),
+				),
+				ut.GenDeploymentCopy("some-experiment-a", "checkout", ut.OwnedByExperiment("some-experiment"), ut.SetCopyStatus(true, 4, 4)),
+			},
+			lists: []ctrlclient.ObjectList{
+				&corev1.ServiceList{},
+				ut.UnstructuredList(ut.VirtualServiceGVK),
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewFakeClientWithScheme(scheme, tc.initialState...)
+
+			rec := controllers.ExperimentReconciler{
+				Client: ut.WithServerSideApply(ut.WithStatusSubresource(client)),
+				Log:    ctrl.Log,
+				Scheme: scheme,
+				Clock:  clocktesting.NewFakePassiveClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+			}
+
+			ctx := context.Background()
+			nn := types.NamespacedName{
+				Namespace: "some-namespace",
+				Name:      "some-experiment",
+			}
+			req := ctrl.Request{NamespacedName: nn}
+			if _, err := rec.Reconcile(ctx, req); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			lists := []ctrlclient.ObjectList{
+				&ddv1beta1.ExperimentList{},
+				&ddv1beta1.DeploymentCopyList{},
+			}
+			lists = append(lists, tc.lists...)
+
+			for _, ls := range lists {
+				if err := client.List(ctx, ls); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+			ifs := make([]interface{}, len(lists))
+			for i, ls := range lists {
+				ifs[i] = ls
+			}
+			ut.SnapshotYaml(t, ifs...)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// variantRouting returns `Routing` of instance matching the name of variant.
+// Weights of variants are approximated by replicas instead
+func variantRouting(instance *duplicationv1beta1.Experiment, variant duplicationv1beta1.ExperimentVariant) *duplicationv1beta1.Routing {
+	if instance.Spec.Routing == nil {
+		return nil
+	}
+	routing := instance.Spec.Routing.DeepCopy()
+	routing.Value = variant.Name
+	routing.Weight = 0
+	return routing
+}
+
+// refreshRoutes clones Services selecting target for the copy of each variant in forks, which are rendered with routing of the variants,
+// and routes requests having the header or cookie with the name of a variant to its clones. The result is reported in the `RoutingReady` condition
+func (r *ExperimentReconciler) refreshRoutes(ctx context.Context, instance *duplicationv1beta1.Experiment, target *appsv1.Deployment, forks []*duplicationv1beta1.DeploymentCopy) error {
+	routing := instance.Spec.Routing
+	useGatewayAPI := routing != nil && routing.GatewayAPI != nil
+
+	// Services cloned for each fork
+	cloned := make([][]client.Object, len(forks))
+	var services []client.Object
+	if routing != nil {
+		for i, fork := range forks {
+			var err error
+			if cloned[i], err = cloneServices(ctx, r.Client, fork, instance.Namespace, []appsv1.Deployment{*target}); err != nil {
+				return err
+			}
+			services = append(services, cloned[i]...)
+		}
+	}
+
+	a := newApplier(r.Client, r.Scheme, instance.Namespace)
+	err := a.Apply(ctx, instance, objectList{
+		Items:            services,
+		GroupVersionKind: corev1.SchemeGroupVersion.WithKind("Service"),
+		Identity:         identityByName,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	istioReason, istioMessage, err := r.refreshIstioRoutes(ctx, instance, a, forks, cloned, routing != nil && !useGatewayAPI)
+	if err != nil {
+		return err
+	}
+	gatewayReason, gatewayMessage, err := r.refreshHTTPRoutes(ctx, instance, a, forks, cloned, useGatewayAPI)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case routing == nil:
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionRoutingReady)
+	case useGatewayAPI && gatewayReason != "":
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, gatewayReason, gatewayMessage)
+	case !useGatewayAPI && istioReason != "":
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, istioReason, istioMessage)
+	case len(services) == 0:
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, "ServiceNotFound", fmt.Sprintf("no Service selects Deployment %s", target.Name))
+	default:
+		descriptions := make([]string, 0, len(forks))
+		for i, fork := range forks {
+			hosts := make([]string, 0, len(cloned[i]))
+			for _, svc := range cloned[i] {
+				hosts = append(hosts, svc.GetName())
+			}
+			descriptions = append(descriptions, fmt.Sprintf("requests matching %s are routed to %s", routingMatchDescription(fork), strings.Join(hosts, ", ")))
+		}
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionTrue, "RoutesGenerated", strings.Join(descriptions, "; "))
+	}
+	return nil
+}
+
+// refreshIstioRoutes generates DestinationRules of the cloned Services and adds rules of all forks to VirtualServices
+// of the source Services when enabled. Otherwise it deletes them. It returns the reason and the message when routes can't be generated
+func (r *ExperimentReconciler) refreshIstioRoutes(ctx context.Context, instance *duplicationv1beta1.Experiment, a *applier, forks []*duplicationv1beta1.DeploymentCopy, cloned [][]client.Object, enabled bool) (string, string, error) {
+	var destinationRules []client.Object
+	clones := make([]map[string]string, len(forks))
+	sources := map[string]bool{}
+	if enabled {
+		found := &unstructured.UnstructuredList{}
+		found.SetGroupVersionKind(destinationRuleGVK.GroupVersion().WithKind(destinationRuleGVK.Kind + "List"))
+		err := r.List(ctx, found, client.InNamespace(instance.Namespace))
+		if meta.IsNoMatchError(err) {
+			return "IstioNotInstalled", "VirtualService and DestinationRule are not available in the cluster", nil
+		}
+		if err != nil {
+			return "", "", errors.WithStack(err)
+		}
+
+		for i, fork := range forks {
+			clones[i] = clonesBySource(fork, cloned[i])
+			for _, obj := range cloned[i] {
+				svc := obj.(*corev1.Service)
+				source := strings.TrimSuffix(svc.Name, "-"+nameSuffix(fork))
+				sources[source] = true
+				destinationRules = append(destinationRules, renderDestinationRule(source, svc, found.Items))
+			}
+		}
+	}
+
+	err := a.Apply(ctx, instance, objectList{
+		Items:            destinationRules,
+		GroupVersionKind: destinationRuleGVK,
+		Identity:         identityByName,
+	})
+	// There's nothing to clean up when Istio isn't installed
+	if len(destinationRules) == 0 && meta.IsNoMatchError(errors.Cause(err)) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	err = injectIstioRules(ctx, r.Client, instance, instance.Namespace, sources, func(rule map[string]interface{}) []interface{} {
+		var rules []interface{}
+		for i, fork := range forks {
+			rules = append(rules, forkIstioRules(fork, rule, instance.Namespace, clones[i])...)
+		}
+		return rules
+	})
+	if meta.IsNoMatchError(errors.Cause(err)) {
+		if enabled {
+			return "IstioNotInstalled", "VirtualService and DestinationRule are not available in the cluster", nil
+		}
+		return "", "", nil
+	}
+	return "", "", err
+}
+
+// refreshHTTPRoutes generates HTTPRoutes of the cloned Services, or adds rules of all forks to the existing one, when enabled.
+// Otherwise it deletes them. It returns the reason and the message when routes can't be generated
+func (r *ExperimentReconciler) refreshHTTPRoutes(ctx context.Context, instance *duplicationv1beta1.Experiment, a *applier, forks []*duplicationv1beta1.DeploymentCopy, cloned [][]client.Object, enabled bool) (string, string, error) {
+	var generated []client.Object
+	var routeName string
+	if enabled {
+		if injectsRules(instance.Spec.Routing) {
+			routeName = instance.Spec.Routing.GatewayAPI.HTTPRouteName
+		} else {
+			for i, fork := range forks {
+				for _, obj := range cloned[i] {
+					generated = append(generated, renderHTTPRoute(fork, obj.(*corev1.Service)))
+				}
+			}
+		}
+	}
+
+	err := a.Apply(ctx, instance, objectList{
+		Items:            generated,
+		GroupVersionKind: httpRouteGVK,
+		Identity:         identityByName,
+	})
+	if meta.IsNoMatchError(errors.Cause(err)) {
+		if enabled {
+			return "GatewayAPINotInstalled", "HTTPRoute is not available in the cluster", nil
+		}
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	clones := make([]map[string]string, len(forks))
+	for i, fork := range forks {
+		clones[i] = clonesBySource(fork, cloned[i])
+	}
+	found, err := injectHTTPRouteRules(ctx, r.Client, instance, instance.Namespace, routeName, func(rule map[string]interface{}) []interface{} {
+		var rules []interface{}
+		for i, fork := range forks {
+			rules = append(rules, forkRulesForBackends(fork, rule, instance.Namespace, clones[i])...)
+		}
+		return rules
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if routeName != "" && !found {
+		return "HTTPRouteNotFound", fmt.Sprintf("HTTPRoute %s is not found in %s", routeName, instance.Namespace), nil
+	}
+	return "", "", nil
+}
+
+// finalize removes rules added to routes, then removes the finalizer. Generated objects are left to the garbage collector
+func (r *ExperimentReconciler) finalize(ctx context.Context, instance *duplicationv1beta1.Experiment) error {
+	if !controllerutil.ContainsFinalizer(instance, finalizerName) {
+		return nil
+	}
+	if err := removeInjectedRules(ctx, r.Client, instance, instance.Namespace); err != nil {
+		return err
+	}
+	controllerutil.RemoveFinalizer(instance, finalizerName)
+	return errors.WithStack(r.Update(ctx, instance))
+}
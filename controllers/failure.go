@@ -0,0 +1,193 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// lastHealthySpecAnnotation records the spec of a DeploymentCopy with which its copied deployments were ready, for `FailureRevert`
+const lastHealthySpecAnnotation = "duplication.k8s.wantedly.com/last-healthy-spec"
+
+// failure is a breach of `FailurePolicy`
+type failure struct {
+	reason  string
+	message string
+}
+
+// checkFailures looks for failures of the copied deployments of targets, and scales them to zero or reverts the spec of instance on failure.
+// The spec is recorded as the last healthy one when the copied deployments are ready without failures
+func (r *DeploymentCopyReconciler) checkFailures(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, targets []appsv1.Deployment, suffix string) error {
+	policy := instance.Spec.FailurePolicy
+	if policy == nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionFailed)
+		return nil
+	}
+	// Copies scaled to zero have no pods to check. They stay failed until the annotation is removed
+	if isSuspended(instance) {
+		return nil
+	}
+
+	ready := len(targets) > 0
+	var found *failure
+	for i := range targets {
+		copied := &appsv1.Deployment{}
+		key := types.NamespacedName{Namespace: targets[i].Namespace, Name: copiedDeploymentName(targets[i].Name, suffix)}
+		if err := r.Get(ctx, key, copied); err != nil {
+			if apierrors.IsNotFound(err) {
+				ready = false
+				continue
+			}
+			return errors.WithStack(err)
+		}
+		ready = ready && isDeploymentReady(copied)
+		f, err := r.findFailure(ctx, policy, copied)
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			found = f
+			break
+		}
+	}
+
+	if found == nil {
+		r.setCondition(instance, duplicationv1beta1.ConditionFailed, metav1.ConditionFalse, "NoFailure", "")
+		// The Ready condition must be observed with the current spec, because the copied deployments may still run the previous one
+		if cond := meta.FindStatusCondition(instance.Status.Conditions, duplicationv1beta1.ConditionReady); ready && cond != nil && cond.Status == metav1.ConditionTrue && cond.ObservedGeneration == instance.Generation {
+			return r.recordHealthySpec(ctx, instance)
+		}
+		return nil
+	}
+
+	r.event(instance, corev1.EventTypeWarning, found.reason, found.message)
+	if policy.Action == duplicationv1beta1.FailureRevert {
+		if spec, ok := lastHealthySpec(instance); ok {
+			// Replicas may be managed through the scale subresource, e.g. by a HorizontalPodAutoscaler
+			spec.Replicas = instance.Spec.Replicas
+			if equality.Semantic.DeepEqual(spec, &instance.Spec) {
+				r.setCondition(instance, duplicationv1beta1.ConditionFailed, metav1.ConditionTrue, found.reason, found.message+", already reverted to the last healthy spec")
+				return nil
+			}
+			instance.Spec = *spec
+			if err := r.update(ctx, instance); err != nil {
+				return err
+			}
+			r.event(instance, corev1.EventTypeNormal, "Reverted", "reverted to the last healthy spec")
+			r.setCondition(instance, duplicationv1beta1.ConditionFailed, metav1.ConditionTrue, found.reason, found.message+", reverted to the last healthy spec")
+			return nil
+		}
+	}
+
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[suspendedAnnotation] = "true"
+	if err := r.update(ctx, instance); err != nil {
+		return err
+	}
+	r.event(instance, corev1.EventTypeNormal, "Suspended", "scaled copied deployments to zero on failure")
+	r.setCondition(instance, duplicationv1beta1.ConditionFailed, metav1.ConditionTrue, found.reason, found.message+", scaled to zero")
+	return nil
+}
+
+// findFailure returns the first failure of copied and its pods, or nil when there's none
+func (r *DeploymentCopyReconciler) findFailure(ctx context.Context, policy *duplicationv1beta1.FailurePolicy, copied *appsv1.Deployment) (*failure, error) {
+	for _, cond := range copied.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing && cond.Status == corev1.ConditionFalse && cond.Reason == "ProgressDeadlineExceeded" {
+			return &failure{reason: "ProgressDeadlineExceeded", message: fmt.Sprintf("Deployment %s exceeded its progress deadline", copied.Name)}, nil
+		}
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(copied.Spec.Selector)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The selector of a copy may also match pods of the original, so pods are matched through the ReplicaSets of copied
+	replicaSets := &appsv1.ReplicaSetList{}
+	if err := r.List(ctx, replicaSets, client.InNamespace(copied.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	owned := map[types.UID]bool{}
+	for i := range replicaSets.Items {
+		if metav1.IsControlledBy(&replicaSets.Items[i], copied) {
+			owned[replicaSets.Items[i].UID] = true
+		}
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(copied.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, pod := range pods.Items {
+		if ref := metav1.GetControllerOf(&pod); ref == nil || !owned[ref.UID] {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+				return &failure{reason: "CrashLoopBackOff", message: fmt.Sprintf("container %s of pod %s is in CrashLoopBackOff", status.Name, pod.Name)}, nil
+			}
+			if policy.MaxRestarts != nil && status.RestartCount > *policy.MaxRestarts {
+				return &failure{reason: "TooManyRestarts", message: fmt.Sprintf("container %s of pod %s restarted %d times", status.Name, pod.Name, status.RestartCount)}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lastHealthySpec returns the spec recorded by recordHealthySpec
+func lastHealthySpec(instance *duplicationv1beta1.DeploymentCopy) (*duplicationv1beta1.DeploymentCopySpec, bool) {
+	value, ok := instance.GetAnnotations()[lastHealthySpecAnnotation]
+	if !ok {
+		return nil, false
+	}
+	spec := &duplicationv1beta1.DeploymentCopySpec{}
+	if err := json.Unmarshal([]byte(value), spec); err != nil {
+		log.Error(err, "invalid annotation", "namespace", instance.Namespace, "name", instance.Name, "annotation", lastHealthySpecAnnotation)
+		return nil, false
+	}
+	return spec, true
+}
+
+// recordHealthySpec records the spec of instance in its annotation unless it is recorded already
+func (r *DeploymentCopyReconciler) recordHealthySpec(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy) error {
+	value, err := json.Marshal(instance.Spec)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if instance.GetAnnotations()[lastHealthySpecAnnotation] == string(value) {
+		return nil
+	}
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[lastHealthySpecAnnotation] = string(value)
+	return r.update(ctx, instance)
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// HTTPRoutes are handled as unstructured objects like Istio kinds
+var httpRouteGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1beta1", Kind: "HTTPRoute"}
+
+// usesExistingHTTPRoute returns true when rules are added to an HTTPRoute which isn't owned by instance
+func usesExistingHTTPRoute(instance *duplicationv1beta1.DeploymentCopy) bool {
+	routing := instance.Spec.Routing
+	return routing != nil && routing.GatewayAPI != nil && routing.GatewayAPI.HTTPRouteName != ""
+}
+
+// refreshHTTPRoutes generates HTTPRoutes, or adds rules to the existing one, when enabled. Otherwise it deletes them.
+// It returns the reason and the message when routes can't be generated
+func (r *DeploymentCopyReconciler) refreshHTTPRoutes(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, a *applier, services []client.Object, enabled bool) (string, string, error) {
+	var generated []client.Object
+	var routeName string
+	if enabled {
+		if usesExistingHTTPRoute(instance) {
+			routeName = instance.Spec.Routing.GatewayAPI.HTTPRouteName
+		} else {
+			for _, obj := range services {
+				svc := obj.(*corev1.Service)
+				generated = append(generated, renderHTTPRoute(instance, svc))
+			}
+		}
+	}
+
+	err := a.Apply(ctx, instance, objectList{
+		Items:            generated,
+		GroupVersionKind: httpRouteGVK,
+		Identity:         identityByName,
+	})
+	if meta.IsNoMatchError(errors.Cause(err)) {
+		if enabled {
+			return "GatewayAPINotInstalled", "HTTPRoute is not available in the cluster", nil
+		}
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	found, err := r.updateHTTPRouteRules(ctx, instance, namespace, routeName, services)
+	if err != nil {
+		return "", "", err
+	}
+	if routeName != "" && !found {
+		return "HTTPRouteNotFound", fmt.Sprintf("HTTPRoute %s is not found in %s", routeName, namespace), nil
+	}
+	if len(generated) > 0 && instance.Spec.Routing.Weight > 0 {
+		return "WeightNotSupported", "generated HTTPRoutes only route matching requests, so weight needs httpRouteName", nil
+	}
+	return "", "", nil
+}
+
+// renderHTTPRoute builds an HTTPRoute which routes matching requests to the clone.
+// Other requests are left to routes of the source Service, which are merged with it by the Gateway
+func renderHTTPRoute(instance *duplicationv1beta1.DeploymentCopy, clone *corev1.Service) *unstructured.Unstructured {
+	gateway := instance.Spec.Routing.GatewayAPI
+	var port int64
+	if len(clone.Spec.Ports) > 0 {
+		port = int64(clone.Spec.Ports[0].Port)
+	}
+
+	parentRefs := make([]interface{}, 0, len(gateway.ParentRefs))
+	for _, parent := range gateway.ParentRefs {
+		parentRef := map[string]interface{}{"name": parent.Name}
+		if parent.Namespace != "" {
+			parentRef["namespace"] = parent.Namespace
+		}
+		if parent.SectionName != "" {
+			parentRef["sectionName"] = parent.SectionName
+		}
+		parentRefs = append(parentRefs, parentRef)
+	}
+	hostnames := make([]interface{}, 0, len(gateway.Hostnames))
+	for _, hostname := range gateway.Hostnames {
+		hostnames = append(hostnames, hostname)
+	}
+
+	match := defaultPathMatch()
+	match["headers"] = []interface{}{headerMatch(instance)}
+	rules := []interface{}{
+		map[string]interface{}{
+			"matches":     []interface{}{match},
+			"backendRefs": []interface{}{backendRef(clone.Name, port, 1)},
+		},
+	}
+
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(httpRouteGVK)
+	route.SetName(clone.Name)
+	route.SetNamespace(clone.Namespace)
+	route.Object["spec"] = map[string]interface{}{
+		"parentRefs": parentRefs,
+		"hostnames":  hostnames,
+		"rules":      rules,
+	}
+	return route
+}
+
+// forkRules derives rules sending requests matching rule to the clone.
+// They should be placed in front of rule, since the first matching rule wins
+func forkRules(instance *duplicationv1beta1.DeploymentCopy, rule map[string]interface{}, sourceRef map[string]interface{}, clone string) []interface{} {
+	routing := instance.Spec.Routing
+	port, _, _ := unstructured.NestedInt64(sourceRef, "port")
+
+	matches, _, _ := unstructured.NestedSlice(rule, "matches")
+	if len(matches) == 0 {
+		matches = []interface{}{defaultPathMatch()}
+	}
+	headerMatches := make([]interface{}, 0, len(matches))
+	for _, m := range matches {
+		match := runtime.DeepCopyJSONValue(m).(map[string]interface{})
+		headers, _, _ := unstructured.NestedSlice(match, "headers")
+		match["headers"] = append(headers, headerMatch(instance))
+		headerMatches = append(headerMatches, match)
+	}
+
+	headerRule := map[string]interface{}{
+		"matches":     headerMatches,
+		"backendRefs": []interface{}{backendRef(clone, port, 1)},
+	}
+	rules := []interface{}{headerRule}
+
+	if routing.Weight > 0 {
+		// The other backends keep their share of the rest of the requests
+		refs, _, _ := unstructured.NestedSlice(rule, "backendRefs")
+		weights := make([]int64, len(refs))
+		for i, ref := range refs {
+			weights[i] = 1
+			if weight, ok, _ := unstructured.NestedInt64(ref.(map[string]interface{}), "weight"); ok {
+				weights[i] = weight
+			}
+		}
+		for i, weight := range scaleWeights(weights, int64(100-routing.Weight)) {
+			refs[i].(map[string]interface{})["weight"] = weight
+		}
+		rules = append(rules, map[string]interface{}{
+			"matches":     runtime.DeepCopyJSONValue(matches),
+			"backendRefs": append(refs, backendRef(clone, port, int64(routing.Weight))),
+		})
+	}
+
+	if filters, ok, _ := unstructured.NestedSlice(rule, "filters"); ok {
+		for _, r := range rules {
+			r.(map[string]interface{})["filters"] = runtime.DeepCopyJSONValue(filters)
+		}
+	}
+	return rules
+}
+
+// headerMatch returns a match for the header or cookie of `Routing`
+func headerMatch(instance *duplicationv1beta1.DeploymentCopy) map[string]interface{} {
+	if instance.Spec.Routing.Cookie != "" {
+		return map[string]interface{}{"type": "RegularExpression", "name": "cookie", "value": cookiePattern(instance)}
+	}
+	return map[string]interface{}{"type": "Exact", "name": routingHeader(instance), "value": routingValue(instance)}
+}
+
+// defaultPathMatch is the match defaulted by the API server, written explicitly to find rules added by us
+func defaultPathMatch() map[string]interface{} {
+	return map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/"}}
+}
+
+// backendRef returns a reference to a Service with the fields defaulted by the API server
+func backendRef(name string, port int64, weight int64) map[string]interface{} {
+	ref := map[string]interface{}{
+		"group":  "",
+		"kind":   "Service",
+		"name":   name,
+		"weight": weight,
+	}
+	if port != 0 {
+		ref["port"] = port
+	}
+	return ref
+}
+
+// updateHTTPRouteRules removes rules added by instance from HTTPRoutes in namespace, then adds rules to routeName when it's not empty.
+// It returns whether routeName was found
+func (r *DeploymentCopyReconciler) updateHTTPRouteRules(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, routeName string, services []client.Object) (bool, error) {
+	clones := clonesBySource(instance, services)
+	return injectHTTPRouteRules(ctx, r.Client, instance, namespace, routeName, func(rule map[string]interface{}) []interface{} {
+		return forkRulesForBackends(instance, rule, namespace, clones)
+	})
+}
+
+// injectHTTPRouteRules removes rules added by owner from HTTPRoutes in namespace, then adds rules derived by fork to routeName when it's not empty.
+// It returns whether routeName was found
+func injectHTTPRouteRules(ctx context.Context, c client.Client, owner client.Object, namespace string, routeName string, fork func(rule map[string]interface{}) []interface{}) (bool, error) {
+	injection := ruleInjection{
+		GroupVersionKind: httpRouteGVK,
+		RulesField:       "rules",
+		Fork:             fork,
+	}
+	if routeName != "" {
+		injection.Targets = func(route *unstructured.Unstructured) bool {
+			return route.GetName() == routeName
+		}
+	}
+	routes, err := listRoutes(ctx, c, namespace, injection)
+	if err != nil {
+		return false, err
+	}
+	targeted, err := injectRules(ctx, c, ruleOwner(owner), routes, injection)
+	return len(targeted) > 0, err
+}
+
+// forkRulesForBackends derives rules from rule when it sends requests to one of the Services cloned into clones
+func forkRulesForBackends(instance *duplicationv1beta1.DeploymentCopy, rule map[string]interface{}, namespace string, clones map[string]string) []interface{} {
+	refs, _, _ := unstructured.NestedSlice(rule, "backendRefs")
+	for _, r := range refs {
+		ref, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(ref, "group")
+		kind, _, _ := unstructured.NestedString(ref, "kind")
+		refNamespace, _, _ := unstructured.NestedString(ref, "namespace")
+		name, _, _ := unstructured.NestedString(ref, "name")
+		if group != "" || (kind != "" && kind != "Service") || (refNamespace != "" && refNamespace != namespace) {
+			continue
+		}
+		if clone, ok := clones[name]; ok {
+			return forkRules(instance, rule, ref, clone)
+		}
+	}
+	return nil
+}
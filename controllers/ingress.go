@@ -0,0 +1,273 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// defaultHostTemplate is used when `HostTemplate` is not defined
+const defaultHostTemplate = "{{ .NameSuffix }}.{{ .Host }}"
+
+// hostTemplateParams are values available in `HostTemplate`
+type hostTemplateParams struct {
+	Host       string
+	NameSuffix string
+}
+
+// cloneIngresses clones Ingresses routing to Services cloned into services, with hosts rewritten by `HostTemplate`.
+// It returns the clones and the URLs served by them.
+// Nothing is cloned when a rewritten host is served by an Ingress which isn't a clone, since the clone would take over its requests
+func (r *DeploymentCopyReconciler) cloneIngresses(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, services []client.Object) ([]client.Object, []string, error) {
+	if instance.Spec.Ingress == nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionIngressReady)
+		return nil, nil, nil
+	}
+	if len(services) == 0 {
+		r.setCondition(instance, duplicationv1beta1.ConditionIngressReady, metav1.ConditionFalse, "ServiceNotFound", "no Service selects the copied deployments")
+		return nil, nil, nil
+	}
+
+	hostTemplate := instance.Spec.Ingress.HostTemplate
+	if hostTemplate == "" {
+		hostTemplate = defaultHostTemplate
+	}
+	tmpl, err := template.New("host").Option("missingkey=error").Parse(hostTemplate)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse hostTemplate")
+	}
+
+	// clones by the name of their source Service
+	clones := map[string]string{}
+	for _, svc := range services {
+		clones[strings.TrimSuffix(svc.GetName(), "-"+nameSuffix(instance))] = svc.GetName()
+	}
+
+	found := &networkingv1.IngressList{}
+	if err := r.List(ctx, found, client.InNamespace(namespace)); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	sourceHosts := map[string]bool{}
+	for i := range found.Items {
+		if isCopiedIngress(&found.Items[i]) {
+			continue
+		}
+		for _, host := range ingressHosts(&found.Items[i]) {
+			sourceHosts[host] = true
+		}
+	}
+
+	var cloned []client.Object
+	urls := map[string]bool{}
+	for i := range found.Items {
+		ingress := &found.Items[i]
+		if !routesToAny(ingress, clones) || isCopiedIngress(ingress) {
+			continue
+		}
+
+		rewritten, err := renderIngress(instance, ingress, tmpl, clones)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rewritten.Spec.Rules) == 0 {
+			continue
+		}
+		for _, host := range ingressHosts(rewritten) {
+			if sourceHosts[host] {
+				message := fmt.Sprintf("hostTemplate rewrites a host of Ingress %s to %s, which is served by an Ingress that isn't a clone", ingress.Name, host)
+				r.setCondition(instance, duplicationv1beta1.ConditionIngressReady, metav1.ConditionFalse, "HostConflict", message)
+				r.event(instance, corev1.EventTypeWarning, "HostConflict", message)
+				return nil, nil, nil
+			}
+		}
+
+		tlsHosts := map[string]bool{}
+		for _, tls := range rewritten.Spec.TLS {
+			for _, host := range tls.Hosts {
+				tlsHosts[host] = true
+			}
+		}
+		for _, rule := range rewritten.Spec.Rules {
+			scheme := "http"
+			if tlsHosts[rule.Host] {
+				scheme = "https"
+			}
+			urls[fmt.Sprintf("%s://%s", scheme, rule.Host)] = true
+		}
+		cloned = append(cloned, rewritten)
+	}
+
+	sorted := make([]string, 0, len(urls))
+	for url := range urls {
+		sorted = append(sorted, url)
+	}
+	sort.Strings(sorted)
+	r.setCondition(instance, duplicationv1beta1.ConditionIngressReady, metav1.ConditionTrue, "IngressesCloned", "")
+	return cloned, sorted, nil
+}
+
+// ingressHosts returns hosts of rules and TLS of ingress
+func ingressHosts(ingress *networkingv1.Ingress) []string {
+	var hosts []string
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host != "" {
+			hosts = append(hosts, rule.Host)
+		}
+	}
+	for _, tls := range ingress.Spec.TLS {
+		hosts = append(hosts, tls.Hosts...)
+	}
+	return hosts
+}
+
+// routesToAny returns true when ingress has a backend in services
+func routesToAny(ingress *networkingv1.Ingress, services map[string]string) bool {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service == nil {
+				continue
+			}
+			if _, ok := services[path.Backend.Service.Name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCopiedIngress returns true when ingress was generated by a DeploymentCopy
+func isCopiedIngress(ingress *networkingv1.Ingress) bool {
+	if _, ok := ingress.GetLabels()[ownerNameLabel]; ok {
+		return true
+	}
+	for _, owner := range ingress.GetOwnerReferences() {
+		if owner.APIVersion == duplicationv1beta1.GroupVersion.String() && owner.Kind == "DeploymentCopy" {
+			return true
+		}
+	}
+	return false
+}
+
+// renderIngress builds a clone of ingress with rewritten hosts and backends pointing at clones.
+// Rules without hosts and the default backend are dropped, since they would conflict with the original.
+// Rules not routing to any clone are dropped too.
+// Certificates of the original are for its hosts, so secret names of TLS and annotations of cert-manager are dropped, leaving the certificate to the default of the ingress controller
+func renderIngress(instance *duplicationv1beta1.DeploymentCopy, ingress *networkingv1.Ingress, tmpl *template.Template, clones map[string]string) (*networkingv1.Ingress, error) {
+	rewriteHost := func(host string) (string, error) {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, hostTemplateParams{Host: host, NameSuffix: nameSuffix(instance)}); err != nil {
+			return "", errors.Wrap(err, "failed to execute hostTemplate")
+		}
+		return b.String(), nil
+	}
+
+	spec := ingress.Spec.DeepCopy()
+	spec.DefaultBackend = nil
+
+	rules := make([]networkingv1.IngressRule, 0, len(spec.Rules))
+	for _, rule := range spec.Rules {
+		if rule.Host == "" {
+			continue
+		}
+		host, err := rewriteHost(rule.Host)
+		if err != nil {
+			return nil, err
+		}
+		rule.Host = host
+		routesToClone := false
+		if rule.HTTP != nil {
+			for i := range rule.HTTP.Paths {
+				backend := rule.HTTP.Paths[i].Backend.Service
+				if backend == nil {
+					continue
+				}
+				if clone, ok := clones[backend.Name]; ok {
+					backend.Name = clone
+					routesToClone = true
+				}
+			}
+		}
+		if routesToClone {
+			rules = append(rules, rule)
+		}
+	}
+	spec.Rules = rules
+
+	hosts := map[string]bool{}
+	for _, rule := range rules {
+		hosts[rule.Host] = true
+	}
+	tlses := make([]networkingv1.IngressTLS, 0, len(spec.TLS))
+	for _, tls := range spec.TLS {
+		rewrittenHosts := make([]string, 0, len(tls.Hosts))
+		for _, host := range tls.Hosts {
+			rewritten, err := rewriteHost(host)
+			if err != nil {
+				return nil, err
+			}
+			if hosts[rewritten] {
+				rewrittenHosts = append(rewrittenHosts, rewritten)
+			}
+		}
+		if len(rewrittenHosts) > 0 {
+			tlses = append(tlses, networkingv1.IngressTLS{Hosts: rewrittenHosts})
+		}
+	}
+	spec.TLS = tlses
+
+	objectMeta := clonedObjectMeta(ingress.ObjectMeta, nameSuffix(instance))
+	var annotations map[string]string
+	for key, value := range objectMeta.Annotations {
+		if isCertManagerAnnotation(key) {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	objectMeta.Annotations = annotations
+
+	return &networkingv1.Ingress{
+		ObjectMeta: objectMeta,
+		Spec:       *spec,
+	}, nil
+}
+
+// isCertManagerAnnotation returns true when key is an annotation requesting a certificate from cert-manager
+func isCertManagerAnnotation(key string) bool {
+	prefix := strings.SplitN(key, "/", 2)[0]
+	return prefix == "cert-manager.io" || strings.HasSuffix(prefix, ".cert-manager.io")
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ownedRulesAnnotation records rules added to a route by each owner, like a DeploymentCopy,
+// so that they can be told apart from rules owned by others
+const ownedRulesAnnotation = "duplication.k8s.wantedly.com/owned-rules"
+
+// sharedRouteLabel marks routes generated to hold rules added by several owners.
+// They are deleted when no rules are owned any more
+const sharedRouteLabel = "duplication.k8s.wantedly.com/shared-route"
+
+// ruleInjection describes how rules of an owner are added to routes of a kind
+type ruleInjection struct {
+	GroupVersionKind schema.GroupVersionKind
+	// RulesField is the field of spec listing rules, where the first matching rule wins
+	RulesField string
+	// Targets returns true when rules are added to route. Rules are only removed when nil
+	Targets func(route *unstructured.Unstructured) bool
+	// Fork derives rules placed in front of rule, which are none when rule doesn't send requests to a cloned Service
+	Fork func(rule map[string]interface{}) []interface{}
+}
+
+// listRoutes lists routes of the kind of injection in namespace
+func listRoutes(ctx context.Context, c client.Client, namespace string, injection ruleInjection) ([]unstructured.Unstructured, error) {
+	routes := &unstructured.UnstructuredList{}
+	routes.SetGroupVersionKind(injection.GroupVersionKind.GroupVersion().WithKind(injection.GroupVersionKind.Kind + "List"))
+	if err := c.List(ctx, routes, client.InNamespace(namespace)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return routes.Items, nil
+}
+
+// injectRules removes rules added by owner from routes, then adds rules derived by injection to the targeted routes.
+// It returns names of the targeted routes
+func injectRules(ctx context.Context, c client.Client, owner string, routes []unstructured.Unstructured, injection ruleInjection) ([]string, error) {
+	var targeted []string
+	for i := range routes {
+		route := &routes[i]
+		owned := map[string][]interface{}{}
+		if value := route.GetAnnotations()[ownedRulesAnnotation]; value != "" {
+			if err := json.Unmarshal([]byte(value), &owned); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse %s of %s %s", ownedRulesAnnotation, injection.GroupVersionKind.Kind, route.GetName())
+			}
+		}
+		target := injection.Targets != nil && injection.Targets(route)
+		if len(owned[owner]) == 0 && !target {
+			continue
+		}
+		if target {
+			targeted = append(targeted, route.GetName())
+		}
+
+		// Rules read back from the API server are compared in JSON, since numbers may have different types
+		previous := map[string]bool{}
+		for _, rule := range owned[owner] {
+			previous[marshalRule(rule)] = true
+		}
+		others := map[string]bool{}
+		for key, rules := range owned {
+			if key == owner {
+				continue
+			}
+			for _, rule := range rules {
+				others[marshalRule(rule)] = true
+			}
+		}
+
+		rules, _, err := unstructured.NestedSlice(route.Object, "spec", injection.RulesField)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var updated, added []interface{}
+		for _, rule := range rules {
+			key := marshalRule(rule)
+			if previous[key] {
+				continue
+			}
+			if target && !others[key] {
+				if m, ok := rule.(map[string]interface{}); ok {
+					forked := injection.Fork(m)
+					added = append(added, forked...)
+					updated = append(updated, forked...)
+				}
+			}
+			updated = append(updated, rule)
+		}
+
+		if len(added) > 0 {
+			owned[owner] = added
+		} else {
+			delete(owned, owner)
+		}
+		if len(owned) == 0 && route.GetLabels()[sharedRouteLabel] == "true" {
+			log.Info("delete shared route without rules", "kind", injection.GroupVersionKind.Kind, "namespace", route.GetNamespace(), "name", route.GetName())
+			// Another owner may have added rules in the meantime
+			version := route.GetResourceVersion()
+			if err := c.Delete(ctx, route, client.Preconditions{ResourceVersion: &version}); client.IgnoreNotFound(err) != nil {
+				return nil, errors.WithStack(err)
+			}
+			continue
+		}
+
+		annotations := route.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		if len(owned) > 0 {
+			value, err := json.Marshal(owned)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			annotations[ownedRulesAnnotation] = string(value)
+		} else {
+			delete(annotations, ownedRulesAnnotation)
+		}
+
+		if marshalRule(rules) == marshalRule(updated) && annotations[ownedRulesAnnotation] == route.GetAnnotations()[ownedRulesAnnotation] {
+			continue
+		}
+		route.SetAnnotations(annotations)
+		if err := unstructured.SetNestedSlice(route.Object, updated, "spec", injection.RulesField); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		log.Info("update rules of route", "kind", injection.GroupVersionKind.Kind, "namespace", route.GetNamespace(), "name", route.GetName(), "rules", len(added))
+		if err := c.Update(ctx, route); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return targeted, nil
+}
+
+// ruleOwner returns the key of rules added by owner in ownedRulesAnnotation, which is `<kind>/<namespace>/<name>`
+func ruleOwner(owner client.Object) string {
+	kind := reflect.Indirect(reflect.ValueOf(owner)).Type().Name()
+	return kind + "/" + owner.GetNamespace() + "/" + owner.GetName()
+}
+
+// removeInjectedRules removes rules added by owner from VirtualServices and HTTPRoutes in namespace
+func removeInjectedRules(ctx context.Context, c client.Client, owner client.Object, namespace string) error {
+	for _, injection := range []ruleInjection{
+		{GroupVersionKind: virtualServiceGVK, RulesField: "http"},
+		{GroupVersionKind: httpRouteGVK, RulesField: "rules"},
+	} {
+		routes, err := listRoutes(ctx, c, namespace, injection)
+		// Optional kinds like Istio's may not be installed
+		if meta.IsNoMatchError(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := injectRules(ctx, c, ruleOwner(owner), routes, injection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func marshalRule(rule interface{}) string {
+	b, _ := json.Marshal(rule)
+	return string(b)
+}
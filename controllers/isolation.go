@@ -0,0 +1,150 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// forkLabel is added to pods of copies with the name suffix so that they are told from pods of the original, and clones of Services can select them
+const forkLabel = "duplication.k8s.wantedly.com/fork"
+
+// isolatedValue rewrites a label value so that selectors of the original Services don't match it
+func isolatedValue(value, suffix string) string {
+	rewritten := fmt.Sprintf("%s-%s", value, suffix)
+	if len(rewritten) > validation.LabelValueMaxLength {
+		rewritten = rewritten[:validation.LabelValueMaxLength]
+	}
+	return strings.TrimRight(rewritten, "-_.")
+}
+
+// isolatePods rewrites labels of copied pods which are selected by Services selecting pods of target
+func isolatePods(copied *appsv1.Deployment, target *appsv1.Deployment, services []corev1.Service, suffix string) {
+	keys := map[string]bool{}
+	for _, svc := range selectingServices(services, target) {
+		for key := range svc.Spec.Selector {
+			keys[key] = true
+		}
+	}
+	rewrite := func(labels map[string]string) {
+		for key := range keys {
+			if value, ok := labels[key]; ok {
+				labels[key] = isolatedValue(value, suffix)
+			}
+		}
+	}
+
+	spec := &copied.Spec
+	if spec.Template.Labels == nil {
+		spec.Template.Labels = map[string]string{}
+	}
+	rewrite(spec.Template.Labels)
+
+	if spec.Selector == nil {
+		spec.Selector = &metav1.LabelSelector{}
+	}
+	if spec.Selector.MatchLabels == nil {
+		spec.Selector.MatchLabels = map[string]string{}
+	}
+	rewrite(spec.Selector.MatchLabels)
+	for i := range spec.Selector.MatchExpressions {
+		expression := &spec.Selector.MatchExpressions[i]
+		if !keys[expression.Key] {
+			continue
+		}
+		for j := range expression.Values {
+			expression.Values[j] = isolatedValue(expression.Values[j], suffix)
+		}
+	}
+}
+
+// checkIsolation reports Services other than clones selecting pods of copiedDeploys in the `Isolated` condition
+func (r *DeploymentCopyReconciler) checkIsolation(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, copiedDeploys []client.Object) error {
+	if !instance.Spec.Isolation {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionIsolated)
+		return nil
+	}
+
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services, client.InNamespace(namespace)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	var leaks []string
+	for _, obj := range copiedDeploys {
+		copied := obj.(*appsv1.Deployment)
+		for _, svc := range services.Items {
+			if len(svc.Spec.Selector) == 0 || isCopiedService(&svc) {
+				continue
+			}
+			if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(copied.Spec.Template.Labels)) {
+				leaks = append(leaks, fmt.Sprintf("%s selects %s", svc.Name, copied.Name))
+			}
+		}
+	}
+	sort.Strings(leaks)
+
+	if len(leaks) > 0 {
+		r.setCondition(instance, duplicationv1beta1.ConditionIsolated, metav1.ConditionFalse, "ServiceSelectsCopy", strings.Join(leaks, ", "))
+	} else {
+		r.setCondition(instance, duplicationv1beta1.ConditionIsolated, metav1.ConditionTrue, "NoServiceSelectsCopy", "")
+	}
+	return nil
+}
+
+// deploymentCopiesForService maps a Service to DeploymentCopies which clone Services or check isolation in its namespace
+func (r *DeploymentCopyReconciler) deploymentCopiesForService(obj client.Object) []reconcile.Request {
+	if _, ok := obj.GetLabels()[ownerNameLabel]; ok {
+		return nil
+	}
+
+	copies := &duplicationv1beta1.DeploymentCopyList{}
+	if err := r.List(context.Background(), copies); err != nil {
+		log.Error(err, "failed to list DeploymentCopies")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range copies.Items {
+		instance := &copies.Items[i]
+		if sourceNamespace(instance) != obj.GetNamespace() {
+			continue
+		}
+		spec := instance.Spec
+		if !spec.Isolation && !spec.RewriteServiceReferences && spec.Routing == nil && spec.Ingress == nil {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}})
+	}
+	return requests
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+var (
+	renderFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deployment_duplicator_render_failures_total",
+		Help: "Number of failures to render copies of DeploymentCopies, by reason",
+	}, []string{"reason"})
+	driftReverts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deployment_duplicator_drift_reverts_total",
+		Help: "Number of changes to copied Deployments made outside of DeploymentCopies and reverted",
+	}, []string{"namespace"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(renderFailures, driftReverts)
+}
+
+var (
+	copiesDesc = prometheus.NewDesc(
+		"deployment_duplicator_copies",
+		"Number of DeploymentCopies by namespace and source Deployment, or label selector of sources",
+		[]string{"namespace", "source_namespace", "source"}, nil,
+	)
+	copyConditionsDesc = prometheus.NewDesc(
+		"deployment_duplicator_copy_conditions",
+		"Number of DeploymentCopies by type and status of conditions",
+		[]string{"namespace", "type", "status"}, nil,
+	)
+	copyCPUDesc = prometheus.NewDesc(
+		"deployment_duplicator_copy_requested_cpu_cores",
+		"CPU requested by pods of copied Deployments of a DeploymentCopy",
+		[]string{"namespace", "name"}, nil,
+	)
+	copyMemoryDesc = prometheus.NewDesc(
+		"deployment_duplicator_copy_requested_memory_bytes",
+		"Memory requested by pods of copied Deployments of a DeploymentCopy",
+		[]string{"namespace", "name"}, nil,
+	)
+	copyAgeDesc = prometheus.NewDesc(
+		"deployment_duplicator_copy_age_seconds",
+		"Seconds since a DeploymentCopy was created",
+		[]string{"namespace", "name"}, nil,
+	)
+)
+
+// CopyCollector collects metrics of DeploymentCopies and their copied Deployments when scraped
+type CopyCollector struct {
+	// Client should read from the cache of the manager, because all DeploymentCopies and Deployments are listed on every scrape
+	Client client.Reader
+	// Clock is used to compute ages of DeploymentCopies. The real clock is used when nil
+	Clock clock.PassiveClock
+}
+
+var _ prometheus.Collector = &CopyCollector{}
+
+// Describe implements prometheus.Collector
+func (c *CopyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- copiesDesc
+	ch <- copyConditionsDesc
+	ch <- copyCPUDesc
+	ch <- copyMemoryDesc
+	ch <- copyAgeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *CopyCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	copies := &duplicationv1beta1.DeploymentCopyList{}
+	if err := c.Client.List(ctx, copies); err != nil {
+		log.Error(err, "failed to list DeploymentCopies for metrics")
+		return
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := c.Client.List(ctx, deployments); err != nil {
+		log.Error(err, "failed to list Deployments for metrics")
+		return
+	}
+
+	now := metav1.Now()
+	if c.Clock != nil {
+		now = metav1.NewTime(c.Clock.Now())
+	}
+
+	type sourceKey struct{ namespace, sourceNamespace, source string }
+	type conditionKey struct{ namespace, conditionType, status string }
+	sources := map[sourceKey]int{}
+	conditions := map[conditionKey]int{}
+	for i := range copies.Items {
+		instance := &copies.Items[i]
+		source := instance.Spec.TargetDeploymentName
+		if instance.Spec.TargetSelector != nil {
+			source = metav1.FormatLabelSelector(instance.Spec.TargetSelector)
+		}
+		sources[sourceKey{instance.Namespace, sourceNamespace(instance), source}]++
+		for _, cond := range instance.Status.Conditions {
+			conditions[conditionKey{instance.Namespace, cond.Type, string(cond.Status)}]++
+		}
+		ch <- prometheus.MustNewConstMetric(copyAgeDesc, prometheus.GaugeValue, now.Sub(instance.CreationTimestamp.Time).Seconds(), instance.Namespace, instance.Name)
+	}
+	for key, count := range sources {
+		ch <- prometheus.MustNewConstMetric(copiesDesc, prometheus.GaugeValue, float64(count), key.namespace, key.sourceNamespace, key.source)
+	}
+	for key, count := range conditions {
+		ch <- prometheus.MustNewConstMetric(copyConditionsDesc, prometheus.GaugeValue, float64(count), key.namespace, key.conditionType, key.status)
+	}
+
+	cpu := map[types.NamespacedName]float64{}
+	memory := map[types.NamespacedName]float64{}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		owner, ok := copyOwner(d)
+		if !ok {
+			continue
+		}
+		var podCPU, podMemory float64
+		for _, container := range d.Spec.Template.Spec.Containers {
+			podCPU += container.Resources.Requests.Cpu().AsApproximateFloat64()
+			podMemory += container.Resources.Requests.Memory().AsApproximateFloat64()
+		}
+		cpu[owner] += podCPU * float64(d.Status.Replicas)
+		memory[owner] += podMemory * float64(d.Status.Replicas)
+	}
+	for owner, value := range cpu {
+		ch <- prometheus.MustNewConstMetric(copyCPUDesc, prometheus.GaugeValue, value, owner.Namespace, owner.Name)
+	}
+	for owner, value := range memory {
+		ch <- prometheus.MustNewConstMetric(copyMemoryDesc, prometheus.GaugeValue, value, owner.Namespace, owner.Name)
+	}
+}
+
+// copyOwner returns the DeploymentCopy which generated d, through labels across namespaces or the owner reference
+func copyOwner(d *appsv1.Deployment) (types.NamespacedName, bool) {
+	if name, ok := d.GetLabels()[ownerNameLabel]; ok {
+		return types.NamespacedName{Namespace: d.GetLabels()[ownerNamespaceLabel], Name: name}, true
+	}
+	owner := metav1.GetControllerOf(d)
+	if owner == nil || owner.APIVersion != duplicationv1beta1.GroupVersion.String() || owner.Kind != "DeploymentCopy" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: d.Namespace, Name: owner.Name}, true
+}
+
+// recordRenderFailure counts a failure to render copies of a DeploymentCopy
+func recordRenderFailure(reason string) {
+	renderFailures.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,74 @@
+package controllers_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	ddv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/wantedly/deployment-duplicator/controllers"
+	ut "github.com/wantedly/deployment-duplicator/controllers/testing"
+)
+
+func TestCopyCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := ddv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	created := func(dc *ddv1beta1.DeploymentCopy) {
+		dc.CreationTimestamp = metav1.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)
+	}
+	requests := func(d *appsv1.Deployment) {
+		d.Spec.Template.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("250m"),
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		}
+	}
+	client := fake.NewFakeClientWithScheme(scheme,
+		ut.GenDeployment("payments", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:latest"), ut.SetReadyStatus(10), requests),
+		ut.GenDeployment("payments-fork-a", map[string]string{"app": "payments"}, ut.AddContainer("app", "payments:a"), ut.SetReadyStatus(2), ut.OwnedBy("fork-a"), requests),
+		ut.GenDeploymentCopy("fork-a", "payments", created, ut.SetCopyStatus(true, 2, 2)),
+		ut.GenDeploymentCopy("fork-b", "payments", created, ut.SetCopyStatus(false, 0, 0)),
+	)
+
+	collector := &controllers.CopyCollector{
+		Client: client,
+		Clock:  clocktesting.NewFakePassiveClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	expected := `
+# HELP deployment_duplicator_copies Number of DeploymentCopies by namespace and source Deployment, or label selector of sources
+# TYPE deployment_duplicator_copies gauge
+deployment_duplicator_copies{namespace="some-namespace",source="payments",source_namespace="some-namespace"} 2
+# HELP deployment_duplicator_copy_age_seconds Seconds since a DeploymentCopy was created
+# TYPE deployment_duplicator_copy_age_seconds gauge
+deployment_duplicator_copy_age_seconds{name="fork-a",namespace="some-namespace"} 86400
+deployment_duplicator_copy_age_seconds{name="fork-b",namespace="some-namespace"} 86400
+# HELP deployment_duplicator_copy_conditions Number of DeploymentCopies by type and status of conditions
+# TYPE deployment_duplicator_copy_conditions gauge
+deployment_duplicator_copy_conditions{namespace="some-namespace",status="False",type="Ready"} 1
+deployment_duplicator_copy_conditions{namespace="some-namespace",status="True",type="Ready"} 1
+# HELP deployment_duplicator_copy_requested_cpu_cores CPU requested by pods of copied Deployments of a DeploymentCopy
+# TYPE deployment_duplicator_copy_requested_cpu_cores gauge
+deployment_duplicator_copy_requested_cpu_cores{name="fork-a",namespace="some-namespace"} 0.5
+# HELP deployment_duplicator_copy_requested_memory_bytes Memory requested by pods of copied Deployments of a DeploymentCopy
+# TYPE deployment_duplicator_copy_requested_memory_bytes gauge
+deployment_duplicator_copy_requested_memory_bytes{name="fork-a",namespace="some-namespace"} 2.68435456e+08
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// Annotations requesting promotion and suspending copies, e.g. with `kubectl annotate`
+const (
+	promoteAnnotation   = "duplication.k8s.wantedly.com/promote"
+	suspendedAnnotation = "duplication.k8s.wantedly.com/suspended"
+)
+
+// isSuspended returns true when copied deployments of instance should be scaled to zero
+func isSuspended(instance *duplicationv1beta1.DeploymentCopy) bool {
+	return instance.GetAnnotations()[suspendedAnnotation] == "true"
+}
+
+// promoteAccess is the permission in `SourceNamespace` which the creator of a DeploymentCopy needs to promote it
+var promoteAccess = []authorizationv1.ResourceAttributes{
+	{Verb: "update", Group: appsv1.GroupName, Resource: "deployments"},
+}
+
+// promote applies images and env of `TargetContainers` to targets in namespace when the promote annotation is set,
+// and then keeps, suspends or deletes instance according to `AfterPromotion`.
+// All targets are validated with a dry run before any of them is updated.
+// It returns true when instance was deleted
+func (r *DeploymentCopyReconciler) promote(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, targets []appsv1.Deployment) (bool, error) {
+	if instance.GetAnnotations()[promoteAnnotation] != "true" {
+		return false, nil
+	}
+
+	// The originals in another namespace are updated by the controller, so the creator has to be allowed to update them.
+	// Originals in the namespace of the DeploymentCopy are trusted like their copies
+	if namespace != instance.Namespace {
+		authorized, message, err := r.authorize(ctx, instance, namespace, promoteAccess)
+		if err != nil {
+			return false, err
+		}
+		if !authorized {
+			r.setCondition(instance, duplicationv1beta1.ConditionPromoted, metav1.ConditionFalse, "Forbidden", message)
+			r.event(instance, corev1.EventTypeWarning, "PromotionFailed", message)
+			return false, nil
+		}
+	}
+
+	containers := make([][]string, len(targets))
+	for i := range targets {
+		target := &targets[i]
+		containers[i] = promoteContainers(instance, target)
+		if err := r.Update(ctx, target.DeepCopy(), client.DryRunAll); err != nil {
+			message := fmt.Sprintf("failed to promote to Deployment %s: %v", target.Name, err)
+			r.setCondition(instance, duplicationv1beta1.ConditionPromoted, metav1.ConditionFalse, "Invalid", message)
+			r.event(instance, corev1.EventTypeWarning, "PromotionFailed", message)
+			return false, errors.WithStack(err)
+		}
+	}
+
+	names := make([]string, 0, len(targets))
+	for i := range targets {
+		target := &targets[i]
+		promoted := containers[i]
+		if err := r.Update(ctx, target); err != nil {
+			message := fmt.Sprintf("failed to promote to Deployment %s: %v", target.Name, err)
+			if len(names) > 0 {
+				// Promotion is retried, and promoting the same containers again doesn't change the promoted targets
+				message = fmt.Sprintf("promoted to %s, but %s", strings.Join(names, ", "), message)
+				r.setCondition(instance, duplicationv1beta1.ConditionPromoted, metav1.ConditionFalse, "PartiallyPromoted", message)
+			} else {
+				r.setCondition(instance, duplicationv1beta1.ConditionPromoted, metav1.ConditionFalse, "Failed", message)
+			}
+			r.event(instance, corev1.EventTypeWarning, "PromotionFailed", message)
+			return false, errors.WithStack(err)
+		}
+		r.event(instance, corev1.EventTypeNormal, "Promoted", fmt.Sprintf("promoted containers %s to Deployment %s", strings.Join(promoted, ", "), target.Name))
+		r.event(target, corev1.EventTypeNormal, "Promoted", fmt.Sprintf("promoted containers %s from DeploymentCopy %s/%s", strings.Join(promoted, ", "), instance.Namespace, instance.Name))
+		names = append(names, target.Name)
+	}
+
+	if instance.Spec.AfterPromotion == duplicationv1beta1.PromotionDelete {
+		if err := r.Delete(ctx, instance); err != nil {
+			return false, errors.WithStack(err)
+		}
+		r.event(instance, corev1.EventTypeNormal, "Deleted", "deleted after promotion")
+		return true, nil
+	}
+
+	// The annotation is removed so that later changes of the original deployments aren't overwritten
+	delete(instance.Annotations, promoteAnnotation)
+	if instance.Spec.AfterPromotion == duplicationv1beta1.PromotionSuspend {
+		instance.Annotations[suspendedAnnotation] = "true"
+	}
+	if err := r.update(ctx, instance); err != nil {
+		return false, err
+	}
+	if isSuspended(instance) {
+		r.event(instance, corev1.EventTypeNormal, "Suspended", "scaled copied deployments to zero after promotion")
+	}
+	r.setCondition(instance, duplicationv1beta1.ConditionPromoted, metav1.ConditionTrue, "Promoted", fmt.Sprintf("promoted to %s", strings.Join(names, ", ")))
+	return false, nil
+}
+
+// promoteContainers overwrites images and env of containers in target with `TargetContainers`, and returns names of the changed containers
+func promoteContainers(instance *duplicationv1beta1.DeploymentCopy, target *appsv1.Deployment) []string {
+	containers := make(map[string]duplicationv1beta1.Container, 0)
+	for _, container := range instance.Spec.TargetContainers {
+		containers[container.Name] = container
+	}
+
+	var promoted []string
+	for i := range target.Spec.Template.Spec.Containers {
+		c := &target.Spec.Template.Spec.Containers[i]
+		container, ok := containers[c.Name]
+		if !ok {
+			continue
+		}
+		c.Image = container.Image
+		for _, env := range container.Env {
+			c.Env = setEnv(c.Env, env)
+		}
+		promoted = append(promoted, c.Name)
+	}
+	return promoted
+}
+
+// setEnv replaces env with the same name in envs, or appends it
+func setEnv(envs []corev1.EnvVar, env corev1.EnvVar) []corev1.EnvVar {
+	for i := range envs {
+		if envs[i].Name == env.Name {
+			envs[i] = env
+			return envs
+		}
+	}
+	return append(envs, env)
+}
+
+// event records an Event of obj when the reconciler has a Recorder
+func (r *DeploymentCopyReconciler) event(obj runtime.Object, eventType, reason, message string) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Event(obj, eventType, reason, message)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// unmanagedReplicas returns names of copied deployments whose replicas are left to others.
+// hpas are HorizontalPodAutoscalers cloned for instance, which may not exist yet
+func (r *DeploymentCopyReconciler) unmanagedReplicas(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, targets []appsv1.Deployment, hpas []client.Object) (map[string]bool, error) {
+	unmanaged := map[string]bool{}
+	// Suspension scales copies to zero regardless of who manages replicas
+	if isSuspended(instance) {
+		return unmanaged, nil
+	}
+	if instance.Spec.ReplicasPolicy == duplicationv1beta1.ReplicasUnmanaged {
+		for i := range targets {
+			unmanaged[copiedDeploymentName(targets[i].Name, nameSuffix(instance))] = true
+		}
+		return unmanaged, nil
+	}
+
+	found := &autoscalingv2.HorizontalPodAutoscalerList{}
+	err := r.List(ctx, found, client.InNamespace(namespace))
+	// autoscaling/v2 isn't served by clusters older than Kubernetes 1.23
+	if err != nil && !meta.IsNoMatchError(err) {
+		return nil, errors.WithStack(err)
+	}
+	autoscalers := make([]*autoscalingv2.HorizontalPodAutoscaler, 0, len(found.Items)+len(hpas))
+	for i := range found.Items {
+		autoscalers = append(autoscalers, &found.Items[i])
+	}
+	for _, obj := range hpas {
+		autoscalers = append(autoscalers, obj.(*autoscalingv2.HorizontalPodAutoscaler))
+	}
+	for _, hpa := range autoscalers {
+		ref := hpa.Spec.ScaleTargetRef
+		if ref.Kind == "Deployment" && ref.APIVersion == appsv1.SchemeGroupVersion.String() {
+			unmanaged[ref.Name] = true
+		}
+	}
+	return unmanaged, nil
+}
+
+// replicasManager is the field manager keeping replicas which the controller stopped applying
+const replicasManager = fieldManager + "-replicas"
+
+// handOverReplicas applies the current replicas of the copied deployment named name under replicasManager,
+// when they were applied by the controller. Otherwise the API server would remove the field when the controller stops applying it,
+// and reset it to the default of 1
+func (r *DeploymentCopyReconciler) handOverReplicas(ctx context.Context, namespace, name string) error {
+	existing := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, existing); err != nil {
+		return errors.WithStack(client.IgnoreNotFound(err))
+	}
+	if existing.Spec.Replicas == nil || !appliesReplicas(existing, fieldManager) {
+		return nil
+	}
+
+	replicas := &unstructured.Unstructured{}
+	replicas.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+	replicas.SetNamespace(namespace)
+	replicas.SetName(name)
+	replicas.Object["spec"] = map[string]interface{}{"replicas": int64(*existing.Spec.Replicas)}
+	err := r.Patch(ctx, replicas, client.Apply, client.FieldOwner(replicasManager))
+	// Replicas were changed by another manager, which owns them now
+	if apierrors.IsConflict(err) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// appliesReplicas returns true when manager applied replicas of d
+func appliesReplicas(d *appsv1.Deployment, manager string) bool {
+	for _, entry := range d.GetManagedFields() {
+		if entry.Manager != manager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Spec map[string]interface{} `json:"f:spec"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields.Spec["f:replicas"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// leaveReplicas renders copied without replicas, so that they aren't applied and the field stays with the managers scaling the copy.
+// The spec hash ignores replicas, which aren't changes made by the DeploymentCopy
+func leaveReplicas(copied *appsv1.Deployment) {
+	copied.Spec.Replicas = nil
+	setSpecHash(copied)
+}
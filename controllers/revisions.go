@@ -0,0 +1,160 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// renderedRevisionName is the name of the ControllerRevision caching the copied deployments rendered last time
+func renderedRevisionName(instance *duplicationv1beta1.DeploymentCopy) string {
+	return fmt.Sprintf("%s-rendered", instance.Name)
+}
+
+// saveRevision stores data in the ControllerRevision named name owned by instance.
+// The revision is incremented when data changes
+func (r *DeploymentCopyReconciler) saveRevision(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, name string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	found := &appsv1.ControllerRevision{}
+	err = r.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: name}, found)
+	if apierrors.IsNotFound(err) {
+		revision := &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: instance.Namespace,
+			},
+			Data:     runtime.RawExtension{Raw: raw},
+			Revision: 1,
+		}
+		if err := controllerutil.SetControllerReference(instance, revision, r.Scheme); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(r.Create(ctx, revision))
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if bytes.Equal(found.Data.Raw, raw) {
+		return nil
+	}
+	found.Data = runtime.RawExtension{Raw: raw}
+	found.Revision++
+	return errors.WithStack(r.Update(ctx, found))
+}
+
+// loadRevision reads data of the ControllerRevision named name into data. It returns false when there's no such revision
+func (r *DeploymentCopyReconciler) loadRevision(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, name string, data interface{}) (bool, error) {
+	found := &appsv1.ControllerRevision{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: name}, found); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+	return true, errors.WithStack(json.Unmarshal(found.Data.Raw, data))
+}
+
+// reconcileMissingSource follows `OnSourceDeleted` when the original deployment is not found
+func (r *DeploymentCopyReconciler) reconcileMissingSource(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace, message string) (ctrl.Result, error) {
+	if instance.Spec.OnSourceDeleted == duplicationv1beta1.SourceDeletedDelete {
+		log.Info("delete DeploymentCopy whose source is missing", "namespace", instance.Namespace, "name", instance.Name)
+		return reconcile.Result{}, errors.WithStack(client.IgnoreNotFound(r.Delete(ctx, instance)))
+	}
+
+	// Requests aren't routed to copies of a missing source, so routes, Ingresses and Services are removed first
+	a := r.applierFor(instance, namespace)
+	if err := r.refreshRoutes(ctx, instance, namespace, a, nil); err != nil {
+		return reconcile.Result{}, err
+	}
+	if instance.Spec.Routing != nil {
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, "SourceNotFound", message)
+	}
+	if instance.Spec.Ingress != nil {
+		r.setCondition(instance, duplicationv1beta1.ConditionIngressReady, metav1.ConditionFalse, "SourceNotFound", message)
+	}
+	instance.Status.URLs = nil
+	for _, gvk := range []schema.GroupVersionKind{
+		networkingv1.SchemeGroupVersion.WithKind("Ingress"),
+		corev1.SchemeGroupVersion.WithKind("Service"),
+	} {
+		if err := a.Apply(ctx, instance, objectList{GroupVersionKind: gvk, Identity: identityByName}); err != nil {
+			return reconcile.Result{}, errors.WithStack(err)
+		}
+	}
+
+	cached := &appsv1.DeploymentList{}
+	found, err := r.loadRevision(ctx, instance, renderedRevisionName(instance), cached)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !found {
+		instance.Status.Deployments = nil
+		instance.Status.Selector = ""
+		instance.Status.Replicas = 0
+		instance.Status.ReadyReplicas = 0
+		r.setCondition(instance, duplicationv1beta1.ConditionReady, metav1.ConditionFalse, "TargetNotFound", message)
+		r.recordConflicts(instance, a.conflicts)
+		return reconcile.Result{}, nil
+	}
+
+	copiedDeploys := make([]client.Object, 0, len(cached.Items))
+	instance.Status.Deployments = nil
+	for i := range cached.Items {
+		copied := &cached.Items[i]
+		if instance.Spec.OnSourceDeleted == duplicationv1beta1.SourceDeletedScaleToZero {
+			replicas := int32(0)
+			copied.Spec.Replicas = &replicas
+		}
+		copiedDeploys = append(copiedDeploys, copied)
+		instance.Status.Deployments = append(instance.Status.Deployments, copied.Name)
+	}
+	instance.Status.Selector = podSelector(copiedDeploys)
+
+	err = a.Apply(ctx, instance, objectList{
+		Items:            copiedDeploys,
+		GroupVersionKind: appsv1.SchemeGroupVersion.WithKind("Deployment"),
+		Identity:         identityByName,
+	})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	r.recordConflicts(instance, a.conflicts)
+	return reconcile.Result{}, r.updateReadiness(ctx, instance, copiedDeploys)
+}
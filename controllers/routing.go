@@ -0,0 +1,415 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// Istio kinds are handled as unstructured objects, so that Istio isn't required to run the controller
+var (
+	virtualServiceGVK  = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "VirtualService"}
+	destinationRuleGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "DestinationRule"}
+)
+
+// defaultRoutingHeader is used when neither `Header` nor `Cookie` is defined
+const defaultRoutingHeader = "x-fork"
+
+// refreshRoutes generates routes to clones of services with Istio or Gateway API
+// and reports the result in the `RoutingReady` condition
+func (r *DeploymentCopyReconciler) refreshRoutes(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, a *applier, services []client.Object) error {
+	routing := instance.Spec.Routing
+	useGatewayAPI := routing != nil && routing.GatewayAPI != nil
+
+	istioReason, istioMessage, err := r.refreshIstioRoutes(ctx, instance, namespace, a, services, routing != nil && !useGatewayAPI)
+	if err != nil {
+		return err
+	}
+	gatewayReason, gatewayMessage, err := r.refreshHTTPRoutes(ctx, instance, namespace, a, services, useGatewayAPI)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case routing == nil:
+		meta.RemoveStatusCondition(&instance.Status.Conditions, duplicationv1beta1.ConditionRoutingReady)
+	case useGatewayAPI && gatewayReason != "":
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, gatewayReason, gatewayMessage)
+	case !useGatewayAPI && istioReason != "":
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, istioReason, istioMessage)
+	case len(services) == 0:
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionFalse, "ServiceNotFound", "no Service selects the copied deployments")
+	default:
+		hosts := make([]string, 0, len(services))
+		for _, svc := range services {
+			hosts = append(hosts, svc.GetName())
+		}
+		r.setCondition(instance, duplicationv1beta1.ConditionRoutingReady, metav1.ConditionTrue, "RoutesGenerated", fmt.Sprintf("requests matching %s are routed to %s", routingMatchDescription(instance), strings.Join(hosts, ", ")))
+	}
+	return nil
+}
+
+// refreshIstioRoutes generates DestinationRules of clones of services and adds rules routing requests to them to VirtualServices
+// of the source Services when enabled. Otherwise it deletes them. It returns the reason and the message when routes can't be generated
+func (r *DeploymentCopyReconciler) refreshIstioRoutes(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string, a *applier, services []client.Object, enabled bool) (string, string, error) {
+	var destinationRules []client.Object
+	// clones by the name of their source Service
+	clones := map[string]string{}
+	sources := map[string]bool{}
+	if enabled {
+		found := &unstructured.UnstructuredList{}
+		found.SetGroupVersionKind(destinationRuleGVK.GroupVersion().WithKind(destinationRuleGVK.Kind + "List"))
+		err := r.List(ctx, found, client.InNamespace(namespace))
+		if meta.IsNoMatchError(err) {
+			return "IstioNotInstalled", "VirtualService and DestinationRule are not available in the cluster", nil
+		}
+		if err != nil {
+			return "", "", errors.WithStack(err)
+		}
+
+		for _, obj := range services {
+			svc := obj.(*corev1.Service)
+			source := strings.TrimSuffix(svc.Name, "-"+nameSuffix(instance))
+			clones[source] = svc.Name
+			sources[source] = true
+			destinationRules = append(destinationRules, renderDestinationRule(source, svc, found.Items))
+		}
+	}
+
+	// VirtualServices aren't generated for each DeploymentCopy, since Istio doesn't merge VirtualServices of the same host.
+	// Ones generated before are deleted
+	lists := []objectList{
+		{
+			Items:            destinationRules,
+			GroupVersionKind: destinationRuleGVK,
+			Identity:         identityByName,
+		},
+		{
+			GroupVersionKind: virtualServiceGVK,
+			Identity:         identityByName,
+		},
+	}
+	for _, list := range lists {
+		err := a.Apply(ctx, instance, list)
+		// There's nothing to clean up when Istio isn't installed
+		if len(list.Items) == 0 && meta.IsNoMatchError(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return "", "", errors.WithStack(err)
+		}
+	}
+
+	err := injectIstioRules(ctx, r.Client, instance, namespace, sources, func(rule map[string]interface{}) []interface{} {
+		return forkIstioRules(instance, rule, namespace, clones)
+	})
+	if meta.IsNoMatchError(errors.Cause(err)) {
+		if enabled {
+			return "IstioNotInstalled", "VirtualService and DestinationRule are not available in the cluster", nil
+		}
+		return "", "", nil
+	}
+	return "", "", err
+}
+
+// injectIstioRules removes rules added by owner from VirtualServices in namespace, then adds rules derived by fork
+// to VirtualServices of sources. A shared VirtualService is generated for each source which no VirtualService routes requests of yet
+func injectIstioRules(ctx context.Context, c client.Client, owner client.Object, namespace string, sources map[string]bool, fork func(rule map[string]interface{}) []interface{}) error {
+	injection := ruleInjection{
+		GroupVersionKind: virtualServiceGVK,
+		RulesField:       "http",
+		Fork:             fork,
+	}
+	if len(sources) > 0 {
+		injection.Targets = func(route *unstructured.Unstructured) bool {
+			return len(coveredSources(route, namespace, sources)) > 0
+		}
+	}
+	routes, err := listRoutes(ctx, c, namespace, injection)
+	if err != nil {
+		return err
+	}
+
+	covered := map[string]bool{}
+	for i := range routes {
+		for source := range coveredSources(&routes[i], namespace, sources) {
+			covered[source] = true
+		}
+	}
+	names := make([]string, 0, len(sources))
+	for source := range sources {
+		names = append(names, source)
+	}
+	sort.Strings(names)
+	for _, source := range names {
+		if covered[source] {
+			continue
+		}
+		vs := renderSharedVirtualService(source, namespace)
+		log.Info("create shared VirtualService", "namespace", namespace, "name", vs.GetName())
+		if err := c.Create(ctx, vs); err != nil {
+			// It may have been created by another owner, which isn't in the cache yet
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			return errors.WithStack(err)
+		}
+		routes = append(routes, *vs)
+	}
+
+	_, err = injectRules(ctx, c, ruleOwner(owner), routes, injection)
+	return err
+}
+
+// injectsRules returns true when routing adds rules to routes which aren't owned by its owner
+func injectsRules(routing *duplicationv1beta1.Routing) bool {
+	return routing != nil && (routing.GatewayAPI == nil || routing.GatewayAPI.HTTPRouteName != "")
+}
+
+// routingValue returns `Value`, or the name suffix when it is not defined
+func routingValue(instance *duplicationv1beta1.DeploymentCopy) string {
+	if instance.Spec.Routing.Value == "" {
+		return nameSuffix(instance)
+	}
+	return instance.Spec.Routing.Value
+}
+
+func routingMatchDescription(instance *duplicationv1beta1.DeploymentCopy) string {
+	routing := instance.Spec.Routing
+	var description string
+	if routing.Cookie != "" {
+		description = fmt.Sprintf("cookie %s=%s", routing.Cookie, routingValue(instance))
+	} else {
+		description = fmt.Sprintf("header %s: %s", routingHeader(instance), routingValue(instance))
+	}
+	if routing.Weight > 0 {
+		description += fmt.Sprintf(" and %d%% of the others", routing.Weight)
+	}
+	return description
+}
+
+// routingHeader returns `Header` in lower case, or the default header when it is not defined
+func routingHeader(instance *duplicationv1beta1.DeploymentCopy) string {
+	if instance.Spec.Routing.Header == "" {
+		return defaultRoutingHeader
+	}
+	return strings.ToLower(instance.Spec.Routing.Header)
+}
+
+// cookiePattern returns a regular expression matching cookie headers having the routing cookie
+func cookiePattern(instance *duplicationv1beta1.DeploymentCopy) string {
+	return fmt.Sprintf(`^(.*;\s*)?%s=%s(;.*)?$`, regexp.QuoteMeta(instance.Spec.Routing.Cookie), regexp.QuoteMeta(routingValue(instance)))
+}
+
+// renderSharedVirtualService builds a VirtualService of the source Service holding rules of every fork,
+// which routes the other requests to the source
+func renderSharedVirtualService(source, namespace string) *unstructured.Unstructured {
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(virtualServiceGVK)
+	vs.SetName(source + "-forks")
+	vs.SetNamespace(namespace)
+	vs.SetLabels(map[string]string{sharedRouteLabel: "true"})
+	vs.Object["spec"] = map[string]interface{}{
+		"hosts": []interface{}{source},
+		"http": []interface{}{
+			map[string]interface{}{
+				"name":  "source",
+				"route": []interface{}{map[string]interface{}{"destination": map[string]interface{}{"host": source}}},
+			},
+		},
+	}
+	return vs
+}
+
+// coveredSources returns Services in sources which are hosts of the VirtualService vs
+func coveredSources(vs *unstructured.Unstructured, namespace string, sources map[string]bool) map[string]bool {
+	covered := map[string]bool{}
+	hosts, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "hosts")
+	for _, host := range hosts {
+		if name := serviceOfHost(host, namespace); sources[name] {
+			covered[name] = true
+		}
+	}
+	return covered
+}
+
+// serviceOfHost returns the name of the Service in namespace which host refers to, or "" when it refers to something else
+func serviceOfHost(host, namespace string) string {
+	for _, suffix := range []string{"." + namespace + ".svc.cluster.local", "." + namespace + ".svc", "." + namespace} {
+		if strings.HasSuffix(host, suffix) {
+			host = strings.TrimSuffix(host, suffix)
+			break
+		}
+	}
+	if strings.Contains(host, ".") || strings.Contains(host, "*") {
+		return ""
+	}
+	return host
+}
+
+// forkIstioRules derives HTTP routes of a VirtualService sending requests matching rule to a clone,
+// when rule sends requests to one of the Services cloned into clones
+func forkIstioRules(instance *duplicationv1beta1.DeploymentCopy, rule map[string]interface{}, namespace string, clones map[string]string) []interface{} {
+	destinations, _, _ := unstructured.NestedSlice(rule, "route")
+	for _, d := range destinations {
+		destination, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		host, _, _ := unstructured.NestedString(destination, "destination", "host")
+		if clone, ok := clones[serviceOfHost(host, namespace)]; ok {
+			return forkIstioRule(instance, rule, destination, clone)
+		}
+	}
+	return nil
+}
+
+// forkIstioRule derives routes sending requests matching rule, and `Weight` percent of the others, to the clone.
+// They should be placed in front of rule, since the first matching route wins
+func forkIstioRule(instance *duplicationv1beta1.DeploymentCopy, rule map[string]interface{}, sourceDestination map[string]interface{}, clone string) []interface{} {
+	routing := instance.Spec.Routing
+	cloneDestination := runtime.DeepCopyJSONValue(sourceDestination).(map[string]interface{})
+	delete(cloneDestination, "weight")
+	destination, _, _ := unstructured.NestedMap(cloneDestination, "destination")
+	destination["host"] = clone
+	// The clone only selects pods of the copy, so subsets of the source Service don't apply to it
+	delete(destination, "subset")
+	cloneDestination["destination"] = destination
+
+	matches, _, _ := unstructured.NestedSlice(rule, "match")
+	if len(matches) == 0 {
+		matches = []interface{}{map[string]interface{}{}}
+	}
+	name, condition := istioHeaderMatch(instance)
+	headerMatches := make([]interface{}, 0, len(matches))
+	for _, m := range matches {
+		match := runtime.DeepCopyJSONValue(m).(map[string]interface{})
+		headers, _, _ := unstructured.NestedMap(match, "headers")
+		if headers == nil {
+			headers = map[string]interface{}{}
+		}
+		headers[name] = condition
+		match["headers"] = headers
+		headerMatches = append(headerMatches, match)
+	}
+
+	headerRule := runtime.DeepCopyJSONValue(rule).(map[string]interface{})
+	headerRule["name"] = "fork-" + nameSuffix(instance)
+	headerRule["match"] = headerMatches
+	headerRule["route"] = []interface{}{cloneDestination}
+	rules := []interface{}{headerRule}
+
+	if routing.Weight > 0 {
+		// The other destinations keep their share of the rest of the requests
+		weightedRule := runtime.DeepCopyJSONValue(rule).(map[string]interface{})
+		weightedRule["name"] = "fork-" + nameSuffix(instance) + "-weighted"
+		destinations, _, _ := unstructured.NestedSlice(weightedRule, "route")
+		weights := make([]int64, len(destinations))
+		for i, d := range destinations {
+			// A single destination without weight receives all requests
+			if len(destinations) == 1 {
+				weights[i] = 100
+			}
+			if weight, ok, _ := unstructured.NestedInt64(d.(map[string]interface{}), "weight"); ok {
+				weights[i] = weight
+			}
+		}
+		for i, weight := range scaleWeights(weights, int64(100-routing.Weight)) {
+			destinations[i].(map[string]interface{})["weight"] = weight
+		}
+		weightedClone := runtime.DeepCopyJSONValue(cloneDestination).(map[string]interface{})
+		weightedClone["weight"] = int64(routing.Weight)
+		weightedRule["route"] = append(destinations, weightedClone)
+		rules = append(rules, weightedRule)
+	}
+	return rules
+}
+
+// scaleWeights scales weights so that they sum up to total, keeping their ratio.
+// The remainder of the rounding is added to the first non-zero weights
+func scaleWeights(weights []int64, total int64) []int64 {
+	var sum int64
+	for _, weight := range weights {
+		sum += weight
+	}
+	scaled := make([]int64, len(weights))
+	if sum <= 0 {
+		return scaled
+	}
+	var assigned int64
+	for i, weight := range weights {
+		scaled[i] = weight * total / sum
+		assigned += scaled[i]
+	}
+	for i := 0; assigned < total; i = (i + 1) % len(weights) {
+		if weights[i] > 0 {
+			scaled[i]++
+			assigned++
+		}
+	}
+	return scaled
+}
+
+// istioHeaderMatch returns the name and the condition of a header match for the header or cookie of `Routing`
+func istioHeaderMatch(instance *duplicationv1beta1.DeploymentCopy) (string, map[string]interface{}) {
+	if instance.Spec.Routing.Cookie != "" {
+		return "cookie", map[string]interface{}{"regex": cookiePattern(instance)}
+	}
+	// Istio requires header names in lower case
+	return routingHeader(instance), map[string]interface{}{"exact": routingValue(instance)}
+}
+
+// renderDestinationRule builds a DestinationRule for the clone.
+// The traffic policy of a DestinationRule for the source Service is inherited when it exists
+func renderDestinationRule(source string, clone *corev1.Service, found []unstructured.Unstructured) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"host": clone.Name,
+	}
+	for _, dr := range found {
+		host, _, _ := unstructured.NestedString(dr.Object, "spec", "host")
+		if serviceOfHost(host, clone.Namespace) != source {
+			continue
+		}
+		if policy, ok, _ := unstructured.NestedMap(dr.Object, "spec", "trafficPolicy"); ok {
+			spec["trafficPolicy"] = policy
+		}
+		break
+	}
+
+	dr := &unstructured.Unstructured{}
+	dr.SetGroupVersionKind(destinationRuleGVK)
+	dr.SetName(clone.Name)
+	dr.SetNamespace(clone.Namespace)
+	dr.Object["spec"] = spec
+	return dr
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// forkedHosts returns hostnames of Services selecting Deployments forked with the same suffix, mapped to the names of their clones.
+// Services are only mapped when their forks clone them, since other hostnames wouldn't resolve
+func (r *DeploymentCopyReconciler) forkedHosts(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string) (map[string]string, error) {
+	suffix := nameSuffix(instance)
+
+	copies := &duplicationv1beta1.DeploymentCopyList{}
+	if err := r.List(ctx, copies, client.InNamespace(instance.Namespace)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var forked []appsv1.Deployment
+	for i := range copies.Items {
+		dc := &copies.Items[i]
+		if nameSuffix(dc) != suffix || sourceNamespace(dc) != namespace || !dc.DeletionTimestamp.IsZero() || !clonesServices(dc) {
+			continue
+		}
+		targets, err := r.getTargets(ctx, dc, namespace)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		forked = append(forked, targets...)
+	}
+
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services, client.InNamespace(namespace)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	hosts := map[string]string{}
+	for i := range forked {
+		for _, svc := range selectingServices(services.Items, &forked[i]) {
+			hosts[svc.Name] = fmt.Sprintf("%s-%s", svc.Name, suffix)
+		}
+	}
+	return hosts, nil
+}
+
+// selectingServices returns Services whose selector matches pods of d
+func selectingServices(services []corev1.Service, d *appsv1.Deployment) []corev1.Service {
+	var selecting []corev1.Service
+	for _, svc := range services {
+		if len(svc.Spec.Selector) == 0 || isCopiedService(&svc) {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(d.Spec.Template.Labels)) {
+			selecting = append(selecting, svc)
+		}
+	}
+	return selecting
+}
+
+// isCopiedService returns true when svc was generated by a DeploymentCopy
+func isCopiedService(svc *corev1.Service) bool {
+	if _, ok := svc.GetLabels()[ownerNameLabel]; ok {
+		return true
+	}
+	for _, owner := range svc.GetOwnerReferences() {
+		if owner.APIVersion == duplicationv1beta1.GroupVersion.String() && owner.Kind == "DeploymentCopy" {
+			return true
+		}
+	}
+	return false
+}
+
+// clonesServices returns true when Services selecting the copied deployments of instance are cloned
+func clonesServices(instance *duplicationv1beta1.DeploymentCopy) bool {
+	return instance.Spec.RewriteServiceReferences || instance.Spec.Routing != nil || instance.Spec.Ingress != nil
+}
+
+// cloneServices clones Services selecting targets so that forked hostnames resolve to the copied pods.
+// The clones select pods with `CustomLabels` in addition to the original selector, which is rewritten with `Isolation`
+func cloneServices(ctx context.Context, c client.Reader, instance *duplicationv1beta1.DeploymentCopy, namespace string, targets []appsv1.Deployment) ([]client.Object, error) {
+	services := &corev1.ServiceList{}
+	if err := c.List(ctx, services, client.InNamespace(namespace)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cloned := map[string]client.Object{}
+	for i := range targets {
+		for _, svc := range selectingServices(services.Items, &targets[i]) {
+			cloned[svc.Name] = renderService(instance, &svc)
+		}
+	}
+
+	names := make([]string, 0, len(cloned))
+	for name := range cloned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	objs := make([]client.Object, 0, len(names))
+	for _, name := range names {
+		objs = append(objs, cloned[name])
+	}
+	return objs, nil
+}
+
+// clonesBySource returns names of services cloned for instance by the name of their source Service
+func clonesBySource(instance *duplicationv1beta1.DeploymentCopy, services []client.Object) map[string]string {
+	clones := map[string]string{}
+	for _, svc := range services {
+		clones[strings.TrimSuffix(svc.GetName(), "-"+nameSuffix(instance))] = svc.GetName()
+	}
+	return clones
+}
+
+// renderService builds a clone of svc selecting pods of copied deployments
+func renderService(instance *duplicationv1beta1.DeploymentCopy, svc *corev1.Service) *corev1.Service {
+	selector := forkSelector(instance, svc.Spec.Selector)
+
+	ports := make([]corev1.ServicePort, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		// node ports can't be shared with the original Service
+		port.NodePort = 0
+		ports = append(ports, port)
+	}
+
+	return &corev1.Service{
+		ObjectMeta: clonedObjectMeta(svc.ObjectMeta, nameSuffix(instance)),
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: selector,
+			Ports:    ports,
+		},
+	}
+}
+
+// forkSelector rewrites labels selecting pods of the original deployments to select only pods of copied deployments
+func forkSelector(instance *duplicationv1beta1.DeploymentCopy, original map[string]string) map[string]string {
+	selector := map[string]string{}
+	for key, value := range original {
+		selector[key] = value
+	}
+	if instance.Spec.Isolation {
+		for key, value := range selector {
+			selector[key] = isolatedValue(value, nameSuffix(instance))
+		}
+	}
+	for key, value := range instance.Spec.CustomLabels {
+		selector[key] = value
+	}
+	selector[forkLabel] = nameSuffix(instance)
+	return selector
+}
+
+// hostReference matches a hostname, optionally qualified with the namespace, which is not a part of another name
+const hostReference = `(^|[^a-zA-Z0-9.-])%s(\.%s(\.svc(\.cluster\.local)?)?)?($|[^a-zA-Z0-9.-])`
+
+// rewriteServiceReferences replaces hosts in env values of copied with their forks
+func rewriteServiceReferences(copied *appsv1.Deployment, namespace string, hosts map[string]string) []duplicationv1beta1.EnvSubstitution {
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	patterns := make([]*regexp.Regexp, 0, len(names))
+	for _, name := range names {
+		patterns = append(patterns, regexp.MustCompile(fmt.Sprintf(hostReference, regexp.QuoteMeta(name), regexp.QuoteMeta(namespace))))
+	}
+
+	podSpec := &copied.Spec.Template.Spec
+	containers := make([]*corev1.Container, 0, len(podSpec.InitContainers)+len(podSpec.Containers))
+	for i := range podSpec.InitContainers {
+		containers = append(containers, &podSpec.InitContainers[i])
+	}
+	for i := range podSpec.Containers {
+		containers = append(containers, &podSpec.Containers[i])
+	}
+
+	var substitutions []duplicationv1beta1.EnvSubstitution
+	for _, container := range containers {
+		for i := range container.Env {
+			env := &container.Env[i]
+			if env.Value == "" {
+				continue
+			}
+			value := env.Value
+			for j, pattern := range patterns {
+				// Boundaries are consumed by a match, so repeat until adjacent references are replaced too
+				for pattern.MatchString(value) {
+					value = pattern.ReplaceAllString(value, "${1}"+hosts[names[j]]+"${2}${5}")
+				}
+			}
+			if value == env.Value {
+				continue
+			}
+			substitutions = append(substitutions, duplicationv1beta1.EnvSubstitution{
+				Deployment: copied.Name,
+				Container:  container.Name,
+				Env:        env.Name,
+				From:       env.Value,
+				To:         value,
+			})
+			env.Value = value
+		}
+	}
+	return substitutions
+}
+
+// deploymentCopiesWithSameSuffix maps a DeploymentCopy to others rewriting references to its forks
+func (r *DeploymentCopyReconciler) deploymentCopiesWithSameSuffix(obj client.Object) []reconcile.Request {
+	instance, ok := obj.(*duplicationv1beta1.DeploymentCopy)
+	if !ok {
+		return nil
+	}
+
+	copies := &duplicationv1beta1.DeploymentCopyList{}
+	if err := r.List(context.Background(), copies, client.InNamespace(instance.Namespace)); err != nil {
+		log.Error(err, "failed to list DeploymentCopies")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range copies.Items {
+		dc := &copies.Items[i]
+		if dc.Name == instance.Name || !dc.Spec.RewriteServiceReferences || nameSuffix(dc) != nameSuffix(instance) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: dc.Name, Namespace: dc.Namespace}})
+	}
+	return requests
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// refreshSourceAnnotation requests taking the snapshot of the original deployments again, e.g. with `kubectl annotate`
+const refreshSourceAnnotation = "duplication.k8s.wantedly.com/refresh-source"
+
+// sourceRevisionName is the name of the ControllerRevision storing the snapshot of `SourcePolicy: Snapshot`
+func sourceRevisionName(instance *duplicationv1beta1.DeploymentCopy) string {
+	return fmt.Sprintf("%s-source", instance.Name)
+}
+
+// pinSources replaces pod templates of targets with the snapshot of `SourcePolicy: Snapshot`.
+// The snapshot is taken when there's none or a refresh is requested, and dropped with `SourcePolicy: Follow`
+func (r *DeploymentCopyReconciler) pinSources(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, targets []appsv1.Deployment) error {
+	if instance.Spec.SourcePolicy != duplicationv1beta1.SourceSnapshot {
+		if instance.Status.SourceSnapshotTime == nil {
+			return nil
+		}
+		revision := &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      sourceRevisionName(instance),
+				Namespace: instance.Namespace,
+			},
+		}
+		if err := r.Delete(ctx, revision); client.IgnoreNotFound(err) != nil {
+			return errors.WithStack(err)
+		}
+		instance.Status.SourceSnapshotTime = nil
+		return nil
+	}
+
+	refresh := instance.GetAnnotations()[refreshSourceAnnotation] == "true"
+	snapshot := &corev1.PodTemplateList{}
+	found := false
+	if !refresh {
+		var err error
+		if found, err = r.loadRevision(ctx, instance, sourceRevisionName(instance), snapshot); err != nil {
+			return err
+		}
+	}
+
+	templates := map[string]corev1.PodTemplateSpec{}
+	for _, template := range snapshot.Items {
+		templates[template.Name] = template.Template
+	}
+	changed := !found
+	for i := range targets {
+		template, ok := templates[targets[i].Name]
+		if !ok {
+			// Deployments which didn't exist when the snapshot was taken are added to it
+			templates[targets[i].Name] = *targets[i].Spec.Template.DeepCopy()
+			changed = true
+			continue
+		}
+		targets[i].Spec.Template = template
+	}
+
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if changed {
+		snapshot.Items = make([]corev1.PodTemplate, 0, len(names))
+		for _, name := range names {
+			snapshot.Items = append(snapshot.Items, corev1.PodTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Template:   templates[name],
+			})
+		}
+		if err := r.saveRevision(ctx, instance, sourceRevisionName(instance), snapshot); err != nil {
+			return err
+		}
+	}
+	if !found {
+		now := r.now()
+		instance.Status.SourceSnapshotTime = &now
+		r.event(instance, corev1.EventTypeNormal, "SourceSnapshotTaken", fmt.Sprintf("took the snapshot of pod templates of Deployments %s", strings.Join(names, ", ")))
+	}
+
+	if refresh {
+		delete(instance.Annotations, refreshSourceAnnotation)
+		if err := r.update(ctx, instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Wantedly, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
+)
+
+// getTargets returns Deployments in namespace which should be copied.
+// It returns a NotFound error when `TargetDeploymentName` doesn't exist.
+func (r *DeploymentCopyReconciler) getTargets(ctx context.Context, instance *duplicationv1beta1.DeploymentCopy, namespace string) ([]appsv1.Deployment, error) {
+	if instance.Spec.TargetSelector == nil {
+		found := &appsv1.Deployment{}
+		if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.TargetDeploymentName, Namespace: namespace}, found); err != nil {
+			return nil, err
+		}
+		return []appsv1.Deployment{*found}, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(instance.Spec.TargetSelector)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	found := &appsv1.DeploymentList{}
+	if err := r.List(ctx, found, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	targets := make([]appsv1.Deployment, 0, len(found.Items))
+	for i := range found.Items {
+		// Copies keep labels of their original Deployments, so they match the selector too
+		if isCopiedDeployment(&found.Items[i]) {
+			continue
+		}
+		targets = append(targets, found.Items[i])
+	}
+	return targets, nil
+}
+
+// isCopiedDeployment returns true when d was generated by a DeploymentCopy, including copies orphaned on deletion
+func isCopiedDeployment(d *appsv1.Deployment) bool {
+	if _, ok := d.GetLabels()[ownerNameLabel]; ok {
+		return true
+	}
+	if _, ok := d.GetLabels()[orphanedLabel]; ok {
+		return true
+	}
+	owner := metav1.GetControllerOf(d)
+	return owner != nil && owner.APIVersion == duplicationv1beta1.GroupVersion.String() && owner.Kind == "DeploymentCopy"
+}
+
+// deploymentCopiesForDeployment maps a Deployment to DeploymentCopies which copy it or own it through labels
+func (r *DeploymentCopyReconciler) deploymentCopiesForDeployment(obj client.Object) []reconcile.Request {
+	if name, ok := obj.GetLabels()[ownerNameLabel]; ok {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: obj.GetLabels()[ownerNamespaceLabel]}}}
+	}
+
+	copies := &duplicationv1beta1.DeploymentCopyList{}
+	if err := r.List(context.Background(), copies); err != nil {
+		log.Error(err, "failed to list DeploymentCopies")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range copies.Items {
+		instance := &copies.Items[i]
+		if sourceNamespace(instance) != obj.GetNamespace() {
+			continue
+		}
+		if instance.Spec.TargetSelector == nil {
+			if instance.Spec.TargetDeploymentName != obj.GetName() {
+				continue
+			}
+		} else {
+			selector, err := metav1.LabelSelectorAsSelector(instance.Spec.TargetSelector)
+			if err != nil || !selector.Matches(labels.Set(obj.GetLabels())) {
+				continue
+			}
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}})
+	}
+	return requests
+}
@@ -2,23 +2,45 @@ package testing
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"gopkg.in/yaml.v2"
+	"net/http"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bradleyjkemp/cupaloy/v2"
 	"github.com/pkg/errors"
 	"github.com/stuart-warren/yamlfmt"
 	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	ddv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
 )
 
 type deploymentOption func(*appsv1.Deployment)
 type deploymentCopyOption func(*ddv1beta1.DeploymentCopy)
+type deploymentCopySetOption func(*ddv1beta1.DeploymentCopySet)
+type podOption func(*v1.Pod)
+type experimentOption func(*ddv1beta1.Experiment)
 
 func GenDeployment(name string, labels map[string]string, opts ...deploymentOption) *appsv1.Deployment {
 	d := &appsv1.Deployment{
@@ -50,12 +72,92 @@ func GenDeployment(name string, labels map[string]string, opts ...deploymentOpti
 	return d
 }
 
+func SetNamespace(namespace string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		d.ObjectMeta.Namespace = namespace
+	}
+}
+
+func OwnedBy(deploymentCopyName string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		controller := true
+		d.ObjectMeta.OwnerReferences = append(d.ObjectMeta.OwnerReferences, metav1.OwnerReference{
+			APIVersion: "duplication.k8s.wantedly.com/v1beta1",
+			Kind:       "DeploymentCopy",
+			Name:       deploymentCopyName,
+			Controller: &controller,
+		})
+	}
+}
+
+// OwnedByCopy makes the DeploymentCopy named deploymentCopyName the controller of obj, like objects cloned for it
+func OwnedByCopy(obj client.Object, deploymentCopyName string) client.Object {
+	controller := true
+	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), metav1.OwnerReference{
+		APIVersion: "duplication.k8s.wantedly.com/v1beta1",
+		Kind:       "DeploymentCopy",
+		Name:       deploymentCopyName,
+		Controller: &controller,
+	}))
+	return obj
+}
+
+// SetUID sets the UID of the deployment to its name, which ReplicaSets of GenReplicaSet refer to
+func SetUID() deploymentOption {
+	return func(d *appsv1.Deployment) {
+		d.ObjectMeta.UID = types.UID(d.Name)
+	}
+}
+
+// ManagedBy records that manager owns fields of the deployment in the FieldsV1 format, like {"f:spec":{"f:replicas":{}}}
+func ManagedBy(manager, fields string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		d.ObjectMeta.ManagedFields = append(d.ObjectMeta.ManagedFields, metav1.ManagedFieldsEntry{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+		})
+	}
+}
+
+// AppliedBy records that manager applied fields of the deployment in the FieldsV1 format, like {"f:spec":{"f:replicas":{}}}
+func AppliedBy(manager, fields string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		d.ObjectMeta.ManagedFields = append(d.ObjectMeta.ManagedFields, metav1.ManagedFieldsEntry{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationApply,
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+		})
+	}
+}
+
+func SetReadyStatus(replicas int32) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		d.Spec.Replicas = &replicas
+		d.Status.Replicas = replicas
+		d.Status.UpdatedReplicas = replicas
+		d.Status.ReadyReplicas = replicas
+	}
+}
+
 func AddContainer(name, image string) deploymentOption {
 	return func(d *appsv1.Deployment) {
 		d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, v1.Container{Name: name, Image: image})
 	}
 }
 
+func AddEnv(containerName, name, value string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		for i := range d.Spec.Template.Spec.Containers {
+			if d.Spec.Template.Spec.Containers[i].Name == containerName {
+				d.Spec.Template.Spec.Containers[i].Env = append(d.Spec.Template.Spec.Containers[i].Env, v1.EnvVar{Name: name, Value: value})
+			}
+		}
+	}
+}
+
 func AddAnnotation(key, value string) deploymentOption {
 	return func(d *appsv1.Deployment) {
 		if d.ObjectMeta.Annotations == nil {
@@ -66,6 +168,334 @@ func AddAnnotation(key, value string) deploymentOption {
 	}
 }
 
+// AddLabel adds a label to metadata of the deployment, leaving its selector and pod template as they are
+func AddLabel(key, value string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		labels := map[string]string{key: value}
+		for k, v := range d.ObjectMeta.Labels {
+			labels[k] = v
+		}
+		d.ObjectMeta.Labels = labels
+	}
+}
+
+func AddConfigMapEnvFrom(containerName, configMapName string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		for i := range d.Spec.Template.Spec.Containers {
+			c := &d.Spec.Template.Spec.Containers[i]
+			if c.Name != containerName {
+				continue
+			}
+			c.EnvFrom = append(c.EnvFrom, v1.EnvFromSource{
+				ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: configMapName}},
+			})
+		}
+	}
+}
+
+func AddSecretKeyRef(containerName, envName, secretName, key string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		for i := range d.Spec.Template.Spec.Containers {
+			c := &d.Spec.Template.Spec.Containers[i]
+			if c.Name != containerName {
+				continue
+			}
+			c.Env = append(c.Env, v1.EnvVar{
+				Name: envName,
+				ValueFrom: &v1.EnvVarSource{
+					SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: secretName}, Key: key},
+				},
+			})
+		}
+	}
+}
+
+func AddConfigMapVolume(volumeName, configMapName string) deploymentOption {
+	return func(d *appsv1.Deployment) {
+		d.Spec.Template.Spec.Volumes = append(d.Spec.Template.Spec.Volumes, v1.Volume{
+			Name: volumeName,
+			VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: configMapName}},
+			},
+		})
+	}
+}
+
+func GenPod(name string, labels map[string]string, opts ...podOption) *v1.Pod {
+	p := &v1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+			Labels:    labels,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// GenReplicaSet generates a ReplicaSet controlled by the deployment named deploymentName, whose UID is set by SetUID
+func GenReplicaSet(name string, labels map[string]string, deploymentName string) *appsv1.ReplicaSet {
+	controller := true
+	return &appsv1.ReplicaSet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+			Labels:    labels,
+			UID:       types.UID(name),
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       deploymentName,
+				UID:        types.UID(deploymentName),
+				Controller: &controller,
+			}},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+		},
+	}
+}
+
+func OwnedByReplicaSet(replicaSetName string) podOption {
+	return func(p *v1.Pod) {
+		controller := true
+		p.ObjectMeta.OwnerReferences = append(p.ObjectMeta.OwnerReferences, metav1.OwnerReference{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+			Name:       replicaSetName,
+			UID:        types.UID(replicaSetName),
+			Controller: &controller,
+		})
+	}
+}
+
+func AddContainerStatus(name string, restarts int32, waitingReason string) podOption {
+	return func(p *v1.Pod) {
+		status := v1.ContainerStatus{Name: name, RestartCount: restarts}
+		if waitingReason != "" {
+			status.State.Waiting = &v1.ContainerStateWaiting{Reason: waitingReason}
+		}
+		p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, status)
+	}
+}
+
+func GenConfigMap(name string, data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+		Data: data,
+	}
+}
+
+func GenService(name string, selector map[string]string) *v1.Service {
+	return &v1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: "10.0.0.1",
+			Selector:  selector,
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+}
+
+// GenIngress generates an Ingress routing each host in hosts to the Service of the same index in services
+func GenIngress(name string, hosts []string, services []string, tls bool) *networkingv1.Ingress {
+	ingress := &networkingv1.Ingress{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "networking.k8s.io/v1",
+			Kind:       "Ingress",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+	}
+	pathType := networkingv1.PathTypePrefix
+	for i, host := range hosts {
+		ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{
+						Path:     "/",
+						PathType: &pathType,
+						Backend: networkingv1.IngressBackend{
+							Service: &networkingv1.IngressServiceBackend{
+								Name: services[i],
+								Port: networkingv1.ServiceBackendPort{Number: 80},
+							},
+						},
+					}},
+				},
+			},
+		})
+	}
+	if tls {
+		ingress.Spec.TLS = []networkingv1.IngressTLS{{Hosts: hosts, SecretName: name + "-tls"}}
+	}
+	return ingress
+}
+
+// AddIngressAnnotation adds an annotation to ingress
+func AddIngressAnnotation(ingress *networkingv1.Ingress, key, value string) *networkingv1.Ingress {
+	if ingress.Annotations == nil {
+		ingress.Annotations = map[string]string{}
+	}
+	ingress.Annotations[key] = value
+	return ingress
+}
+
+// GenHorizontalPodAutoscaler generates a HorizontalPodAutoscaler scaling the Deployment named target on CPU utilization
+func GenHorizontalPodAutoscaler(name, target string, minReplicas, maxReplicas int32) *autoscalingv2.HorizontalPodAutoscaler {
+	utilization := int32(80)
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "autoscaling/v2",
+			Kind:       "HorizontalPodAutoscaler",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       target,
+			},
+			MinReplicas: &minReplicas,
+			MaxReplicas: maxReplicas,
+			Metrics: []autoscalingv2.MetricSpec{{
+				Type: autoscalingv2.ResourceMetricSourceType,
+				Resource: &autoscalingv2.ResourceMetricSource{
+					Name:   v1.ResourceCPU,
+					Target: autoscalingv2.MetricTarget{Type: autoscalingv2.UtilizationMetricType, AverageUtilization: &utilization},
+				},
+			}},
+		},
+	}
+}
+
+// GenPodDisruptionBudget generates a PodDisruptionBudget selecting pods with selector
+func GenPodDisruptionBudget(name string, selector map[string]string, minAvailable intstr.IntOrString) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "policy/v1",
+			Kind:       "PodDisruptionBudget",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector:     &metav1.LabelSelector{MatchLabels: selector},
+			MinAvailable: &minAvailable,
+		},
+	}
+}
+
+// GenRenderedRevision generates the ControllerRevision caching deployments rendered for the DeploymentCopy named deploymentCopyName
+func GenRenderedRevision(deploymentCopyName string, deployments ...*appsv1.Deployment) *appsv1.ControllerRevision {
+	list := &appsv1.DeploymentList{}
+	for _, d := range deployments {
+		list.Items = append(list.Items, *d)
+	}
+	// Marshaling a DeploymentList never fails
+	raw, _ := json.Marshal(list)
+	return &appsv1.ControllerRevision{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "ControllerRevision",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deploymentCopyName + "-rendered",
+			Namespace: "some-namespace",
+		},
+		Data:     runtime.RawExtension{Raw: raw},
+		Revision: 1,
+	}
+}
+
+// GenSourceRevision generates the ControllerRevision storing the snapshot of pod templates of deployments for the DeploymentCopy named deploymentCopyName
+func GenSourceRevision(deploymentCopyName string, deployments ...*appsv1.Deployment) *appsv1.ControllerRevision {
+	list := &v1.PodTemplateList{}
+	for _, d := range deployments {
+		list.Items = append(list.Items, v1.PodTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: d.Name},
+			Template:   d.Spec.Template,
+		})
+	}
+	// Marshaling a PodTemplateList never fails
+	raw, _ := json.Marshal(list)
+	return &appsv1.ControllerRevision{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "ControllerRevision",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deploymentCopyName + "-source",
+			Namespace: "some-namespace",
+		},
+		Data:     runtime.RawExtension{Raw: raw},
+		Revision: 1,
+	}
+}
+
+func SetSourcePolicy(policy ddv1beta1.SourcePolicy) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.SourcePolicy = policy
+	}
+}
+
+func SetOnSourceDeleted(action ddv1beta1.SourceDeletedAction) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.OnSourceDeleted = action
+	}
+}
+
+func GenSecret(name string, data map[string]string) *v1.Secret {
+	s := &v1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+		Data: map[string][]byte{},
+	}
+	for key, value := range data {
+		s.Data[key] = []byte(value)
+	}
+	return s
+}
+
 func GenDeploymentCopy(name string, targetDeployment string, opts ...deploymentCopyOption) *ddv1beta1.DeploymentCopy {
 	dc := &ddv1beta1.DeploymentCopy{
 		TypeMeta: metav1.TypeMeta{
@@ -95,6 +525,20 @@ func AddTargetContainer(name, image string) deploymentCopyOption {
 		})
 	}
 }
+func AddTargetEnv(containerName, name, value string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		for i := range dc.Spec.TargetContainers {
+			if dc.Spec.TargetContainers[i].Name == containerName {
+				dc.Spec.TargetContainers[i].Env = append(dc.Spec.TargetContainers[i].Env, v1.EnvVar{Name: name, Value: value})
+			}
+		}
+	}
+}
+func SetAfterPromotion(action ddv1beta1.PromotionAction) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.AfterPromotion = action
+	}
+}
 func AddCustomLabel(key, value string) deploymentCopyOption {
 	return func(dc *ddv1beta1.DeploymentCopy) {
 		if dc.Spec.CustomLabels == nil {
@@ -113,6 +557,620 @@ func AddCustomAnnotation(key, value string) deploymentCopyOption {
 		dc.Spec.CustomAnnotations[key] = value
 	}
 }
+func SetNameSuffix(suffix string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.NameSuffix = suffix
+	}
+}
+func EnableServiceRewrite() deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.RewriteServiceReferences = true
+	}
+}
+func SetRouting(routing ddv1beta1.Routing) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.Routing = &routing
+	}
+}
+func SetIngress(hostTemplate string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.Ingress = &ddv1beta1.IngressCopy{HostTemplate: hostTemplate}
+	}
+}
+func SetDeletionPolicy(policy ddv1beta1.DeletionPolicy) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.DeletionPolicy = policy
+	}
+}
+func SetConflictPolicy(policy ddv1beta1.ConflictPolicy) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.ConflictPolicy = policy
+	}
+}
+func SetReplicasPolicy(policy ddv1beta1.ReplicasPolicy) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.ReplicasPolicy = policy
+	}
+}
+func SetHorizontalPodAutoscaler(minReplicas, maxReplicas *int32) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.HorizontalPodAutoscaler = &ddv1beta1.HorizontalPodAutoscalerCopy{MinReplicas: minReplicas, MaxReplicas: maxReplicas}
+	}
+}
+func SetPodDisruptionBudget(maxUnavailable *intstr.IntOrString) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.PodDisruptionBudget = &ddv1beta1.PodDisruptionBudgetCopy{MaxUnavailable: maxUnavailable}
+	}
+}
+func SetCanaryWeight(weight int32) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.CanaryWeight = weight
+	}
+}
+func SetCanarySteps(steps ...ddv1beta1.CanaryStep) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.CanarySteps = steps
+	}
+}
+func SetCanaryStatus(step int32, startedAt time.Time) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Status.Canary = &ddv1beta1.CanaryStatus{
+			CurrentStep:   step,
+			StepStartedAt: metav1.NewTime(startedAt),
+			Phase:         ddv1beta1.CanaryProgressing,
+		}
+	}
+}
+func AddCopyAnnotation(key, value string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		if dc.Annotations == nil {
+			dc.Annotations = map[string]string{}
+		}
+		dc.Annotations[key] = value
+	}
+}
+func SetAnalysis(metrics ...ddv1beta1.AnalysisMetric) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.Analysis = &ddv1beta1.Analysis{Metrics: metrics}
+	}
+}
+func SetFailurePolicy(action ddv1beta1.FailureAction, maxRestarts *int32) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.FailurePolicy = &ddv1beta1.FailurePolicy{Action: action, MaxRestarts: maxRestarts}
+	}
+}
+func SetLastHealthySpec(spec ddv1beta1.DeploymentCopySpec) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		value, err := json.Marshal(spec)
+		if err != nil {
+			panic(err)
+		}
+		if dc.Annotations == nil {
+			dc.Annotations = map[string]string{}
+		}
+		dc.Annotations["duplication.k8s.wantedly.com/last-healthy-spec"] = string(value)
+	}
+}
+func EnableIsolation() deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.Isolation = true
+	}
+}
+func SetReplicas(replicas int32) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.Replicas = replicas
+	}
+}
+
+func SetTargetSelector(matchLabels map[string]string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.TargetDeploymentName = ""
+		dc.Spec.TargetSelector = &metav1.LabelSelector{MatchLabels: matchLabels}
+	}
+}
+func AddSourceNamespace(namespace string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Spec.SourceNamespace = namespace
+	}
+}
+func AddCreator(user string, groups ...string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		if dc.ObjectMeta.Annotations == nil {
+			dc.ObjectMeta.Annotations = map[string]string{}
+		}
+		dc.ObjectMeta.Annotations["duplication.k8s.wantedly.com/creator"] = user
+		dc.ObjectMeta.Annotations["duplication.k8s.wantedly.com/creator-groups"] = strings.Join(groups, ",")
+	}
+}
+func SetAppliedNamespace(namespace string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Status.SourceNamespace = namespace
+	}
+}
+func MarkDeleted() deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		deletedAt := metav1.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		dc.ObjectMeta.DeletionTimestamp = &deletedAt
+		dc.ObjectMeta.Finalizers = append(dc.ObjectMeta.Finalizers, "duplication.k8s.wantedly.com/finalizer")
+	}
+}
+func AddConfigMapOverride(name string, data map[string]string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		if dc.Spec.ConfigOverrides == nil {
+			dc.Spec.ConfigOverrides = &ddv1beta1.ConfigOverrides{}
+		}
+		dc.Spec.ConfigOverrides.ConfigMaps = append(dc.Spec.ConfigOverrides.ConfigMaps, ddv1beta1.ConfigOverride{Name: name, Data: data})
+	}
+}
+func AddSecretOverride(name string, data map[string]string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		if dc.Spec.ConfigOverrides == nil {
+			dc.Spec.ConfigOverrides = &ddv1beta1.ConfigOverrides{}
+		}
+		dc.Spec.ConfigOverrides.Secrets = append(dc.Spec.ConfigOverrides.Secrets, ddv1beta1.ConfigOverride{Name: name, Data: data})
+	}
+}
+func OwnedBySet(deploymentCopySetName string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		controller := true
+		dc.ObjectMeta.OwnerReferences = append(dc.ObjectMeta.OwnerReferences, metav1.OwnerReference{
+			APIVersion: "duplication.k8s.wantedly.com/v1beta1",
+			Kind:       "DeploymentCopySet",
+			Name:       deploymentCopySetName,
+			Controller: &controller,
+		})
+	}
+}
+func SetCopyStatus(ready bool, replicas, readyReplicas int32) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		status := metav1.ConditionFalse
+		reason := "DeploymentsNotReady"
+		if ready {
+			status = metav1.ConditionTrue
+			reason = "DeploymentsReady"
+		}
+		dc.Status.Replicas = replicas
+		dc.Status.ReadyReplicas = readyReplicas
+		dc.Status.Conditions = append(dc.Status.Conditions, metav1.Condition{
+			Type:               ddv1beta1.ConditionReady,
+			Status:             status,
+			LastTransitionTime: metav1.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+			Reason:             reason,
+		})
+	}
+}
+
+func GenDeploymentCopySet(name string, opts ...deploymentCopySetOption) *ddv1beta1.DeploymentCopySet {
+	set := &ddv1beta1.DeploymentCopySet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "duplication.k8s.wantedly.com/v1beta1",
+			Kind:       "DeploymentCopySet",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+	}
+
+	for _, opt := range opts {
+		opt(set)
+	}
+	return set
+}
+func AddMember(targetDeployment, containerName, image string) deploymentCopySetOption {
+	return func(set *ddv1beta1.DeploymentCopySet) {
+		set.Spec.Members = append(set.Spec.Members, ddv1beta1.DeploymentCopySetMember{
+			TargetDeploymentName: targetDeployment,
+			TargetContainers:     []ddv1beta1.Container{{Name: containerName, Image: image}},
+		})
+	}
+}
+func SetSetNameSuffix(suffix string) deploymentCopySetOption {
+	return func(set *ddv1beta1.DeploymentCopySet) {
+		set.Spec.NameSuffix = suffix
+	}
+}
+
+func GenExperiment(name string, targetDeployment string, opts ...experimentOption) *ddv1beta1.Experiment {
+	experiment := &ddv1beta1.Experiment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "duplication.k8s.wantedly.com/v1beta1",
+			Kind:       "Experiment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "some-namespace",
+		},
+		Spec: ddv1beta1.ExperimentSpec{
+			TargetDeploymentName: targetDeployment,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(experiment)
+	}
+	return experiment
+}
+func AddVariant(name string, weight int32, containerName, image string) experimentOption {
+	return func(experiment *ddv1beta1.Experiment) {
+		experiment.Spec.Variants = append(experiment.Spec.Variants, ddv1beta1.ExperimentVariant{
+			Name:             name,
+			Weight:           weight,
+			TargetContainers: []ddv1beta1.Container{{Name: containerName, Image: image}},
+		})
+	}
+}
+func SetExperimentRouting(routing ddv1beta1.Routing) experimentOption {
+	return func(experiment *ddv1beta1.Experiment) {
+		experiment.Spec.Routing = &routing
+	}
+}
+func MarkExperimentDeleted() experimentOption {
+	return func(experiment *ddv1beta1.Experiment) {
+		deletedAt := metav1.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		experiment.ObjectMeta.DeletionTimestamp = &deletedAt
+		experiment.ObjectMeta.Finalizers = append(experiment.ObjectMeta.Finalizers, "duplication.k8s.wantedly.com/finalizer")
+	}
+}
+func OwnedByExperiment(experimentName string) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		controller := true
+		dc.ObjectMeta.OwnerReferences = append(dc.ObjectMeta.OwnerReferences, metav1.OwnerReference{
+			APIVersion: "duplication.k8s.wantedly.com/v1beta1",
+			Kind:       "Experiment",
+			Name:       experimentName,
+			Controller: &controller,
+		})
+	}
+}
+func SetCopyAnalysisStatus(healthy metav1.ConditionStatus, results ...ddv1beta1.AnalysisResult) deploymentCopyOption {
+	return func(dc *ddv1beta1.DeploymentCopy) {
+		dc.Status.Analysis = &ddv1beta1.AnalysisStatus{
+			LastAnalysisTime: metav1.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+			Results:          results,
+		}
+		dc.Status.Conditions = append(dc.Status.Conditions, metav1.Condition{
+			Type:               ddv1beta1.ConditionHealthy,
+			Status:             healthy,
+			LastTransitionTime: metav1.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+			Reason:             "AnalysisPassed",
+		})
+	}
+}
+
+var (
+	VirtualServiceGVK  = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "VirtualService"}
+	DestinationRuleGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "DestinationRule"}
+	HTTPRouteGVK       = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1beta1", Kind: "HTTPRoute"}
+)
+
+// AddIstioToScheme registers Istio kinds as unstructured objects, like CRDs installed in a cluster
+func AddIstioToScheme(s *runtime.Scheme) error {
+	for _, gvk := range []schema.GroupVersionKind{VirtualServiceGVK, DestinationRuleGVK} {
+		s.AddKnownTypeWithName(gvk, &unstructured.Unstructured{})
+		s.AddKnownTypeWithName(gvk.GroupVersion().WithKind(gvk.Kind+"List"), &unstructured.UnstructuredList{})
+	}
+	return nil
+}
+
+// AddGatewayAPIToScheme registers Gateway API kinds as unstructured objects, like CRDs installed in a cluster
+func AddGatewayAPIToScheme(s *runtime.Scheme) error {
+	s.AddKnownTypeWithName(HTTPRouteGVK, &unstructured.Unstructured{})
+	s.AddKnownTypeWithName(HTTPRouteGVK.GroupVersion().WithKind(HTTPRouteGVK.Kind+"List"), &unstructured.UnstructuredList{})
+	return nil
+}
+
+func GenUnstructured(gvk schema.GroupVersionKind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetGroupVersionKind(gvk)
+	u.SetName(name)
+	u.SetNamespace("some-namespace")
+	return u
+}
+
+func AddUnstructuredAnnotation(u *unstructured.Unstructured, key, value string) *unstructured.Unstructured {
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key] = value
+	u.SetAnnotations(annotations)
+	return u
+}
+
+func AddUnstructuredLabel(u *unstructured.Unstructured, key, value string) *unstructured.Unstructured {
+	labels := u.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[key] = value
+	u.SetLabels(labels)
+	return u
+}
+
+func UnstructuredList(gvk schema.GroupVersionKind) *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	return list
+}
+
+// accessReviewClient answers SubjectAccessReviews instead of the API server
+type accessReviewClient struct {
+	client.Client
+	denied map[string]bool
+}
+
+// DrainEvents returns Events recorded so far by recorder
+func DrainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// PrometheusStub serves results in the format of the Prometheus HTTP API, looking up results by queries.
+// Unknown queries result in an empty vector
+func PrometheusStub(results map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := []interface{}{}
+		if value, ok := results[r.URL.Query().Get("query")]; ok {
+			result = append(result, map[string]interface{}{
+				"metric": map[string]string{},
+				"value":  []interface{}{1640995200, value},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     result,
+			},
+		})
+	})
+}
+
+// WithAccessReviews returns a client which answers SubjectAccessReviews, since the fake client can't evaluate them.
+// Accesses in denied, like "create secrets", are denied and the others are allowed
+func WithAccessReviews(c client.Client, denied ...string) client.Client {
+	accesses := map[string]bool{}
+	for _, access := range denied {
+		accesses[access] = true
+	}
+	return &accessReviewClient{Client: c, denied: accesses}
+}
+
+func (c *accessReviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = !c.denied[attributes.Verb+" "+attributes.Resource]
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// applyClient emulates server-side apply, which the fake client doesn't support, by merging fields of field managers.
+// Lists are owned as a whole. Fields of objects which weren't applied yet are owned by the managers in their managedFields,
+// like ones set by ManagedBy, and the other fields by the controller
+type applyClient struct {
+	client.Client
+	// managers maps objects to their fields and the field managers owning them
+	managers map[string]map[string]map[string]bool
+}
+
+// controllerManager is the field manager of the controllers
+const controllerManager = "deployment-duplicator"
+
+// pathSeparator joins keys of a field, which may contain dots like label keys
+const pathSeparator = "\x00"
+
+// WithServerSideApply returns a client which handles apply patches
+func WithServerSideApply(c client.Client) client.Client {
+	return &applyClient{Client: c, managers: map[string]map[string]map[string]bool{}}
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	options := &client.PatchOptions{}
+	options.ApplyOptions(opts)
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	applied := &unstructured.Unstructured{}
+	if err := utiljson.Unmarshal(data, &applied.Object); err != nil {
+		return err
+	}
+	manager := options.FieldManager
+	key := fmt.Sprintf("%s/%s/%s", applied.GetKind(), applied.GetNamespace(), applied.GetName())
+	fields := appliedFields(applied.Object)
+
+	found := &unstructured.Unstructured{}
+	found.SetGroupVersionKind(applied.GroupVersionKind())
+	err = c.Get(ctx, client.ObjectKeyFromObject(applied), found)
+	if apierrors.IsNotFound(err) {
+		owners := map[string]map[string]bool{}
+		for path := range fields {
+			owners[path] = map[string]bool{manager: true}
+		}
+		c.managers[key] = owners
+		if err := c.Create(ctx, applied); err != nil {
+			return err
+		}
+		return c.Get(ctx, client.ObjectKeyFromObject(applied), obj)
+	}
+	if err != nil {
+		return err
+	}
+
+	owners, ok := c.managers[key]
+	if !ok {
+		owners = initialOwners(found)
+		c.managers[key] = owners
+	}
+	found.SetManagedFields(nil)
+
+	var causes []metav1.StatusCause
+	changed := map[string]bool{}
+	for path, value := range fields {
+		current, exists, _ := unstructured.NestedFieldNoCopy(found.Object, strings.Split(path, pathSeparator)...)
+		if exists && equality.Semantic.DeepEqual(current, value) {
+			continue
+		}
+		changed[path] = true
+		for other := range owners[path] {
+			if other != manager && (options.Force == nil || !*options.Force) {
+				causes = append(causes, metav1.StatusCause{
+					Type:    metav1.CauseTypeFieldManagerConflict,
+					Message: fmt.Sprintf("conflict with %q: .%s", other, strings.ReplaceAll(path, pathSeparator, ".")),
+					Field:   "." + strings.ReplaceAll(path, pathSeparator, "."),
+				})
+			}
+		}
+	}
+	if len(causes) > 0 {
+		sort.Slice(causes, func(i, j int) bool { return causes[i].Message < causes[j].Message })
+		messages := make([]string, 0, len(causes))
+		for _, cause := range causes {
+			messages = append(messages, cause.Message)
+		}
+		return apierrors.NewApplyConflict(causes, fmt.Sprintf("Apply failed with %d conflict: %s", len(causes), strings.Join(messages, ", ")))
+	}
+
+	for path, value := range fields {
+		if changed[path] || owners[path] == nil {
+			// Forcing the ownership takes changed fields from the other managers
+			owners[path] = map[string]bool{}
+		}
+		owners[path][manager] = true
+		if err := unstructured.SetNestedField(found.Object, runtime.DeepCopyJSONValue(value), strings.Split(path, pathSeparator)...); err != nil {
+			return err
+		}
+	}
+	// Fields which the manager stopped applying are removed unless other managers own them
+	for path, managers := range owners {
+		if _, ok := fields[path]; ok || !managers[manager] {
+			continue
+		}
+		delete(managers, manager)
+		if len(managers) == 0 {
+			unstructured.RemoveNestedField(found.Object, strings.Split(path, pathSeparator)...)
+			delete(owners, path)
+		}
+	}
+	if err := c.Update(ctx, found); err != nil {
+		return err
+	}
+	return c.Get(ctx, client.ObjectKeyFromObject(found), obj)
+}
+
+// appliedFields returns fields of content which field managers can own, keyed by their paths
+func appliedFields(content map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for key, value := range content {
+		switch key {
+		case "apiVersion", "kind", "status":
+			continue
+		case "metadata":
+			metadata, _ := value.(map[string]interface{})
+			for _, field := range []string{"labels", "annotations", "ownerReferences"} {
+				if v, ok := metadata[field]; ok {
+					collectFields([]string{key, field}, v, fields)
+				}
+			}
+			continue
+		}
+		collectFields([]string{key}, value, fields)
+	}
+	return fields
+}
+
+func collectFields(path []string, value interface{}, fields map[string]interface{}) {
+	if m, ok := value.(map[string]interface{}); ok && len(m) > 0 {
+		for key, v := range m {
+			collectFields(append(path[:len(path):len(path)], key), v, fields)
+		}
+		return
+	}
+	fields[strings.Join(path, pathSeparator)] = value
+}
+
+// initialOwners returns the owners of fields of obj, which are the managers in its managedFields or the controller
+func initialOwners(obj *unstructured.Unstructured) map[string]map[string]bool {
+	owners := map[string]map[string]bool{}
+	for _, entry := range obj.GetManagedFields() {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		for _, path := range managedPaths(nil, fields) {
+			if owners[path] == nil {
+				owners[path] = map[string]bool{}
+			}
+			owners[path][entry.Manager] = true
+		}
+	}
+	for path := range appliedFields(obj.Object) {
+		if owners[path] == nil {
+			owners[path] = map[string]bool{controllerManager: true}
+		}
+	}
+	return owners
+}
+
+// managedPaths returns paths of fields in the FieldsV1 format, like {"f:spec":{"f:replicas":{}}}
+func managedPaths(path []string, fields map[string]interface{}) []string {
+	var paths []string
+	for key, value := range fields {
+		if !strings.HasPrefix(key, "f:") {
+			continue
+		}
+		child := append(path[:len(path):len(path)], strings.TrimPrefix(key, "f:"))
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			paths = append(paths, managedPaths(child, nested)...)
+			continue
+		}
+		paths = append(paths, strings.Join(child, pathSeparator))
+	}
+	return paths
+}
+
+// statusClient keeps the status on Update like the API server does for resources with the status subresource
+type statusClient struct {
+	client.Client
+}
+
+// WithStatusSubresource returns a client whose Update doesn't overwrite the status of Deployments and DeploymentCopies
+func WithStatusSubresource(c client.Client) client.Client {
+	return &statusClient{Client: c}
+}
+
+func (c *statusClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	switch obj := obj.(type) {
+	case *appsv1.Deployment:
+		found := &appsv1.Deployment{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), found); err == nil {
+			obj.Status = found.Status
+		}
+	case *ddv1beta1.DeploymentCopy:
+		found := &ddv1beta1.DeploymentCopy{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), found); err == nil {
+			obj.Status = found.Status
+		}
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
 
 func SnapshotYaml(t *testing.T, objs ...interface{}) {
 	t.Helper()
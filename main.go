@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -27,9 +28,14 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	duplicationv1beta1 "github.com/wantedly/deployment-duplicator/api/v1beta1"
 	"github.com/wantedly/deployment-duplicator/controllers"
@@ -52,8 +58,12 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var prometheusAddr string
+	var prometheusTimeout time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&prometheusAddr, "prometheus-address", "", "The address of the Prometheus HTTP API used for analysis of DeploymentCopies, e.g. http://prometheus.monitoring:9090.")
+	flag.DurationVar(&prometheusTimeout, "prometheus-timeout", 30*time.Second, "The timeout of each query to the Prometheus HTTP API.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -72,21 +82,51 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "3025a49c.k8s.wantedly.com",
+		NewClient:              newClient,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	// The webhook needs serving certificates, so it is enabled only when configured with config/webhook
+	enableWebhooks := os.Getenv("ENABLE_WEBHOOKS") == "true"
+
+	var metricsProvider controllers.MetricsProvider
+	if prometheusAddr != "" {
+		metricsProvider = &controllers.PrometheusClient{Address: prometheusAddr, Timeout: prometheusTimeout}
+	}
 	if err = (&controllers.DeploymentCopyReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		Metrics:        metricsProvider,
+		Recorder:       mgr.GetEventRecorderFor("deploymentcopy-controller"),
+		CreatorWebhook: enableWebhooks,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DeploymentCopy")
+		os.Exit(1)
+	}
+	if err = (&controllers.DeploymentCopySetReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "DeploymentCopy")
+		setupLog.Error(err, "unable to create controller", "controller", "DeploymentCopySet")
 		os.Exit(1)
 	}
+	if err = (&controllers.ExperimentReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Experiment")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		mgr.GetWebhookServer().Register(controllers.CreatorWebhookPath, &webhook.Admission{Handler: &controllers.CreatorAnnotator{}})
+	}
 	//+kubebuilder:scaffold:builder
 
+	metrics.Registry.MustRegister(&controllers.CopyCollector{Client: mgr.GetClient()})
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -102,3 +142,18 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newClient returns a client reading from the cache, which caches unstructured objects as well.
+// Kinds without Go types like Istio's VirtualServices are read as unstructured
+func newClient(cache cache.Cache, config *rest.Config, options client.Options, uncachedObjects ...client.Object) (client.Client, error) {
+	c, err := client.New(config, options)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewDelegatingClient(client.NewDelegatingClientInput{
+		CacheReader:       cache,
+		Client:            c,
+		UncachedObjects:   uncachedObjects,
+		CacheUnstructured: true,
+	})
+}